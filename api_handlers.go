@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/coreos/go-omaha/omaha"
+	"net"
 	"strconv"
 )
 
@@ -17,18 +19,86 @@ const (
 	eventResultDone  = 2
 )
 
-// parse an 'app' tag of request and generate a corresponding 'app' tag of response
-func handleApiApp(logContext *logrus.Entry, localUrl string, appRequest, appResponse *omaha.App) {
+var eventTypeNames = map[int]string{
+	eventTypeDownload: "download",
+	eventTypeArrive:   "arrive",
+	eventTypeApply:    "apply",
+	eventTypeSuccess:  "success",
+}
+
+var eventResultNames = map[int]string{
+	eventResultError: "error",
+	eventResultOK:    "ok",
+	eventResultDone:  "done",
+}
+
+func eventTypeName(evType int) string {
+	if name, ok := eventTypeNames[evType]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%v)", evType)
+}
+
+func eventResultName(evResult int) string {
+	if name, ok := eventResultNames[evResult]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%v)", evResult)
+}
+
+// accepts both a name known to eventTypeName and a raw number
+func parseEventType(s string) (int, error) {
+	for value, name := range eventTypeNames {
+		if name == s {
+			return value, nil
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+// accepts both a name known to eventResultName and a raw number
+func parseEventResult(s string) (int, error) {
+	for value, name := range eventResultNames {
+		if name == s {
+			return value, nil
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+// parse an 'app' tag of request and generate a corresponding 'app' tag of response;
+// the app's details and the outcome are filled into 'record'
+func handleApiApp(logContext *logrus.Entry, localUrl string, appRequest, appResponse *omaha.App, record *ClientRequest) {
 	logContext = logContext.WithFields(logrus.Fields{
 		"machineId": appRequest.MachineID,
 	})
 
-	if appRequest.Id != coreOSAppID {
+	// clients which report no track are served the app's default channel
+	app, known := apps[appRequest.Id]
+	if known && appRequest.Track == "" {
+		appRequest.Track = app.DefaultChannel
+	}
+
+	record.MachineID = appRequest.MachineID
+	record.AppID = appRequest.Id
+	record.Version = appRequest.Version
+	record.Track = appRequest.Track
+	record.OEM = appRequest.OEM
+	record.OEMVersion = appRequest.OEMVersion
+	record.BootID = appRequest.BootId
+	record.Events = len(appRequest.Events)
+
+	if !known {
 		appResponse.Status = "error-unknownApplication"
 	} else {
 		appResponse.Status = "ok"
 	}
 
+	// <Event> tag
+	// handled before the update check, so that events are attributed to
+	// the payload offered previously rather than in this response
+	handleApiEvents(logContext, appRequest)
+
 	// <UpdateCheck> tag
 	if appRequest.UpdateCheck != nil {
 		logContext.Debug("Handling UpdateCheck")
@@ -39,8 +109,22 @@ func handleApiApp(logContext *logrus.Entry, localUrl string, appRequest, appResp
 			logContext.Errorf("Could not parse client's version string: %v", err.Error())
 			ucResp.Status = "error-invalidVersionString"
 		} else {
-			handleApiUpdateCheck(logContext, localUrl, appVersion, appRequest.Track, appRequest.UpdateCheck, ucResp)
+			offered := handleApiUpdateCheck(logContext, localUrl, net.ParseIP(record.RemoteAddr), appVersion, appRequest.Track, appRequest.UpdateCheck, ucResp)
+			if offered != nil {
+				record.OfferedID = offered.ID
+				record.OfferedVersion = offered.Version
+
+				err = db.SetMachineOffer(appRequest.MachineID, offered.ID)
+				if err != nil {
+					logContext.Errorf("Failed to store the offered payload: %v", err.Error())
+				}
+			}
 		}
+
+		record.UpdateCheck = true
+		record.Status = ucResp.Status
+	} else {
+		record.Status = appResponse.Status
 	}
 
 	// <ping> tag
@@ -50,14 +134,23 @@ func handleApiApp(logContext *logrus.Entry, localUrl string, appRequest, appResp
 		// response is always "ok" according to the specs
 		responsePing := appResponse.AddPing()
 		responsePing.Status = "ok"
+		record.Ping = true
 	}
 
-	// <Event> tag
-	handleApiEvents(logContext, appRequest.MachineID, appRequest.Events)
 }
 
-func handleApiEvents(logContext *logrus.Entry, client string, events []*omaha.Event) error {
-	for _, event := range events {
+func handleApiEvents(logContext *logrus.Entry, appRequest *omaha.App) error {
+	if len(appRequest.Events) == 0 {
+		return nil
+	}
+
+	// the payload the events most likely refer to
+	payloadID, err := db.GetMachineOffer(appRequest.MachineID)
+	if err != nil {
+		logContext.Errorf("Failed to retrieve the payload offered to the client: %v", err.Error())
+	}
+
+	for _, event := range appRequest.Events {
 		evType, err := strconv.Atoi(event.Type)
 		if err != nil {
 			return err
@@ -68,10 +161,37 @@ func handleApiEvents(logContext *logrus.Entry, client string, events []*omaha.Ev
 			return err
 		}
 
-		err = db.LogEvent(client, evType, evResult)
-		if err != nil {
-			logContext.Error(err)
+		var errorCode int
+		if event.ErrorCode != "" {
+			errorCode, err = strconv.Atoi(event.ErrorCode)
+			if err != nil {
+				logContext.Warnf("Invalid error code '%v'", event.ErrorCode)
+			}
+		}
+
+		ev := Event{
+			MachineID:       appRequest.MachineID,
+			Type:            evType,
+			Result:          evResult,
+			Channel:         appRequest.Track,
+			Version:         appRequest.Version,
+			PreviousVersion: event.PreviousVersion,
+			PayloadID:       payloadID,
+			ErrorCode:       errorCode,
 		}
+		logEvent(ev)
+		broadcast(liveEvent, nameEvents([]Event{ev})[0])
+		if evResult == eventResultError {
+			notify(webhookMachineError, map[string]interface{}{
+				"machineId": appRequest.MachineID,
+				"channel":   appRequest.Track,
+				"version":   appRequest.Version,
+				"payloadId": payloadID,
+				"eventType": eventTypeName(evType),
+				"errorCode": errorCode,
+			})
+		}
+
 		switch evType {
 		case eventTypeDownload:
 			logContext.Info("Client is downloading new version.")
@@ -82,21 +202,22 @@ func handleApiEvents(logContext *logrus.Entry, client string, events []*omaha.Ev
 			case eventResultOK:
 				logContext.Info("Client applied package.")
 			case eventResultError:
-				logContext.Info("Client errored during update.")
+				logContext.Infof("Client errored during update (error code %v).", errorCode)
 			case eventResultDone:
 				logContext.Info("Client upgraded to current version.")
 			}
 		case eventTypeSuccess:
 			logContext.Info("Install success. Update completion prevented by instance.")
 		default:
-			logContext.Warn("Unknown event type %v.", evType)
+			logContext.Warnf("Unknown event type %v.", evType)
 		}
 	}
 	return nil
 }
 
-// parse an 'UpdateCheck' tag of request and generate a corresponding 'UpdateCheck' tag of response
-func handleApiUpdateCheck(logContext *logrus.Entry, localUrl string, appVersion payloadVersion, channel string, ucRequest, ucResp *omaha.UpdateCheck) {
+// parse an 'UpdateCheck' tag of request and generate a corresponding 'UpdateCheck' tag of response;
+// returns the payload offered to the client, if any
+func handleApiUpdateCheck(logContext *logrus.Entry, localUrl string, client net.IP, appVersion payloadVersion, channel string, ucRequest, ucResp *omaha.UpdateCheck) *payload {
 	payload, err := db.GetNewerPayload(appVersion, channel)
 	if err != nil {
 		logContext.Errorf("Failed checking for newer payload: %v", err.Error())
@@ -105,18 +226,38 @@ func handleApiUpdateCheck(logContext *logrus.Entry, localUrl string, appVersion
 		if payload == nil {
 			logContext.Infof("Client already up-to-date")
 			ucResp.Status = "noupdate"
-			return
+			return nil
 		}
 
 		logContext.Infof("Found update to version '%v' (id %v)", payload.Version, payload.ID)
 
+		id, sha1, sha256, size := payload.ID, payload.SHA1, payload.SHA256, payload.Size
+		isDelta := false
+
+		// prefer a delta from the client's exact version, fall back to the full image
+		delta, err := db.GetDelta(appVersion, payload.ID)
+		if err != nil {
+			logContext.Errorf("Failed checking for delta payload: %v", err.Error())
+		} else if delta != nil {
+			logContext.Infof("Using delta payload %v from version '%v'", delta.ID, delta.SourceVersion)
+			id, sha1, sha256, size = delta.ID, delta.SHA1, delta.SHA256, delta.Size
+			isDelta = true
+		}
+
 		ucResp.Status = "ok"
-		ucResp.AddUrl(fileBE.GetUpdateURL(localUrl))
+		// update_engine tries the URLs in order until a download succeeds
+		for _, codebase := range downloadURLs(client, localUrl, id) {
+			ucResp.AddUrl(codebase)
+		}
 
-		manifest := ucResp.AddManifest("1.0.2")
-		manifest.AddPackage(payload.SHA1, payload.ID, strconv.FormatInt(payload.Size, 10), true)
+		// update_engine takes the version it installs from the manifest
+		manifest := ucResp.AddManifest(payload.Version)
+		manifest.AddPackage(sha1, id, strconv.FormatInt(size, 10), true)
 		action := manifest.AddAction("postinstall")
-		action.Sha256 = payload.SHA256
+		action.Sha256 = sha256
+		action.IsDelta = isDelta
 		action.DisablePayloadBackoff = true
 	}
+
+	return payload
 }
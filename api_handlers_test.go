@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/kdomanski/comaha/file-backends/local"
+	"testing"
+	"time"
+)
+
+// answer an update check of a machine running 'version' on 'channel'
+func checkForUpdate(t *testing.T, version, channel string) *omaha.UpdateCheck {
+	appVersion, err := parseVersionString(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ucResp := &omaha.UpdateCheck{}
+	handleApiUpdateCheck(logrus.WithField("test", t.Name()), "http://localhost/file", nil, appVersion, channel, &omaha.UpdateCheck{}, ucResp)
+	return ucResp
+}
+
+func TestUpdateCheckManifestVersion(t *testing.T) {
+	defer func(oldDB userDB, oldBE fileBackend) { db, fileBE = oldDB, oldBE }(db, fileBE)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+	fileBE = local.New("")
+
+	db.AddPayload("xyz", "sha1", "sha256", 7, payloadVersion{build: 800, branch: 1, patch: 2, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("xyz", "stable")
+
+	ucResp := checkForUpdate(t, "766.4.0", "stable")
+	if ucResp.Status != "ok" || ucResp.Manifest == nil {
+		t.Fatalf("Expected an update, got %+v", ucResp)
+	}
+	// the version the machine will report after installing the payload
+	if ucResp.Manifest.Version != "800.1.2" {
+		t.Errorf("Expected manifest version '800.1.2', got '%v'", ucResp.Manifest.Version)
+	}
+}
+
+func TestUpdateCheckEmptyChannel(t *testing.T) {
+	defer func(oldDB userDB) { db = oldDB }(db)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+
+	// a channel nothing was uploaded to yet, or an unknown one
+	if ucResp := checkForUpdate(t, "766.4.0", "stable"); ucResp.Status != "noupdate" {
+		t.Errorf("Expected status 'noupdate', got '%v'", ucResp.Status)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+)
+
+// Protect an admin handler with the token given by --admin-token. The token
+// is accepted as a bearer token (for scripts) or as the password of HTTP basic
+// authentication with any user name (for browsers viewing the panel).
+// With --tls-client-ca, a client certificate signed by that CA is accepted
+// instead of the token. Without either, all requests are let through.
+func requireAdmin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		open := opts.AdminToken == "" && opts.TLSClientCA == ""
+		byToken := opts.AdminToken != "" && adminAuthorized(r, opts.AdminToken)
+		byCert := opts.TLSClientCA != "" && hasVerifiedClientCert(r)
+
+		if open || byToken || byCert {
+			h(w, r, ps)
+			return
+		}
+
+		if opts.AdminToken != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="comaha"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+func adminAuthorized(r *http.Request, token string) bool {
+	var presented string
+
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		presented = strings.TrimPrefix(h, "Bearer ")
+	} else if _, password, ok := r.BasicAuth(); ok {
+		presented = password
+	}
+
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
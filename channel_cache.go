@@ -0,0 +1,116 @@
+package main
+
+import "sync"
+
+// Everything needed to answer update checks for a channel
+type channelHead struct {
+	// sorted by ascending version
+	images         []chainPayload
+	forceDowngrade bool
+}
+
+// the payload a client running 'current' should be offered, nil if none
+func (h *channelHead) newerPayload(current payloadVersion) *payload {
+	// yanked payloads are never offered
+	good := []chainPayload{}
+	for _, p := range h.images {
+		if !p.Yanked {
+			good = append(good, p)
+		}
+	}
+
+	if len(good) == 0 {
+		return nil
+	}
+
+	latest := good[len(good)-1]
+	if h.forceDowngrade && current.IsGreater(latest.version) {
+		return &latest.payload
+	}
+
+	if next := nextPayloadInChain(current, h.images); next != nil {
+		return next
+	}
+
+	return downgradeFromYanked(current, h.images, good)
+}
+
+// Channel heads and deltas by target payload, kept in memory as they only
+// change through the admin API. Every change invalidates the whole cache;
+// the generation tells loads which were running at that time not to store
+// their possibly outdated results.
+type channelCache struct {
+	mutex      sync.RWMutex
+	generation uint64
+	heads      map[string]*channelHead
+	deltas     map[string][]delta
+}
+
+func newChannelCache() *channelCache {
+	return &channelCache{
+		heads:  make(map[string]*channelHead),
+		deltas: make(map[string][]delta),
+	}
+}
+
+func (c *channelCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	c.heads = make(map[string]*channelHead)
+	c.deltas = make(map[string][]delta)
+}
+
+// the cached head of 'channel', obtained from 'load' if missing
+func (c *channelCache) head(channel string, load func() (*channelHead, error)) (*channelHead, error) {
+	c.mutex.RLock()
+	head, ok := c.heads[channel]
+	generation := c.generation
+	c.mutex.RUnlock()
+	if ok {
+		return head, nil
+	}
+
+	head, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	// clients choose the channel name, so only channels which exist are kept
+	if len(head.images) == 0 && !head.forceDowngrade {
+		return head, nil
+	}
+
+	c.mutex.Lock()
+	if c.generation == generation {
+		c.heads[channel] = head
+	}
+	c.mutex.Unlock()
+
+	return head, nil
+}
+
+// the cached deltas to payload 'target', obtained from 'load' if missing
+func (c *channelCache) deltasTo(target string, load func() ([]delta, error)) ([]delta, error) {
+	c.mutex.RLock()
+	deltas, ok := c.deltas[target]
+	generation := c.generation
+	c.mutex.RUnlock()
+	if ok {
+		return deltas, nil
+	}
+
+	deltas, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	if c.generation == generation {
+		c.deltas[target] = deltas
+	}
+	c.mutex.Unlock()
+
+	return deltas, nil
+}
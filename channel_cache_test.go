@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestChannelCacheGeneration(t *testing.T) {
+	c := newChannelCache()
+
+	// a load overlapping an invalidation is not stored
+	head, err := c.head("stable", func() (*channelHead, error) {
+		c.invalidate()
+		return &channelHead{forceDowngrade: true}, nil
+	})
+	if err != nil || head == nil {
+		t.Fatalf("Expected the loaded head, got %+v, %v", head, err)
+	}
+	if _, ok := c.heads["stable"]; ok {
+		t.Error("Head loaded during an invalidation was cached")
+	}
+
+	c.head("stable", func() (*channelHead, error) {
+		return &channelHead{forceDowngrade: true}, nil
+	})
+	if _, ok := c.heads["stable"]; !ok {
+		t.Error("Head was not cached")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	flags "github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+)
+
+// settings of an application served by comaha
+type appConfig struct {
+	ID   string `yaml:"id"`
+	Name string `yaml:"name"`
+
+	// channel used for clients which do not report a track
+	DefaultChannel string `yaml:"default_channel"`
+}
+
+// applications known to the server, by app ID
+var apps = map[string]appConfig{
+	coreOSAppID: {ID: coreOSAppID, Name: "CoreOS"},
+}
+
+// sections of the configuration file which have no command line equivalent
+type fileConfig struct {
+	Apps      []appConfig      `yaml:"apps"`
+	Mirrors   []mirrorConfig   `yaml:"mirrors"`
+	Upstreams []upstreamConfig `yaml:"upstreams"`
+}
+
+// The configuration file is a YAML mapping whose keys are the long names of
+// the command line options, plus the sections of fileConfig. Its values
+// become the defaults of the respective options, so that environment
+// variables and flags take precedence.
+func loadConfigFile(parser *flags.Parser, filename string) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings map[string]interface{}
+	err = yaml.Unmarshal(data, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("parsing '%v': %v", filename, err.Error())
+	}
+
+	var sections fileConfig
+	err = yaml.Unmarshal(data, &sections)
+	if err != nil {
+		return nil, fmt.Errorf("parsing apps, mirrors and upstreams in '%v': %v", filename, err.Error())
+	}
+
+	for key, value := range settings {
+		if key == "apps" || key == "mirrors" || key == "upstreams" {
+			continue
+		}
+
+		option := parser.FindOptionByLongName(key)
+		if option == nil || key == "config" {
+			return nil, fmt.Errorf("unknown setting '%v' in '%v'", key, filename)
+		}
+
+		var values []string
+		switch v := value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("setting '%v' in '%v' must not be a mapping", key, filename)
+		case nil:
+			// keep the built-in default
+			continue
+		default:
+			values = []string{fmt.Sprint(v)}
+		}
+
+		option.Default = values
+	}
+
+	return &sections, nil
+}
+
+// find the configuration file in the command line or the environment
+// without failing on the options which are parsed later
+func configFileName(args []string) string {
+	var pre struct {
+		Config string `short:"c" long:"config" env:"COMAHA_CONFIG"`
+	}
+
+	parser := flags.NewParser(&pre, flags.IgnoreUnknown)
+	parser.ParseArgs(args)
+
+	return pre.Config
+}
+
+// use the apps from the configuration file instead of the built-in ones
+func setApps(configured []appConfig) error {
+	if len(configured) == 0 {
+		return nil
+	}
+
+	known := make(map[string]appConfig)
+	for _, app := range configured {
+		if app.ID == "" {
+			return errors.New("an app is missing its 'id'")
+		}
+		if _, ok := known[app.ID]; ok {
+			return fmt.Errorf("app '%v' is configured more than once", app.ID)
+		}
+		known[app.ID] = app
+	}
+
+	apps = known
+	return nil
+}
+
+// check the settings for mistakes which would otherwise only show up at runtime
+func validateConfig() error {
+	if opts.Port < 1 || opts.Port > 65535 {
+		return fmt.Errorf("invalid port %v", opts.Port)
+	}
+
+	if (opts.TLSCert == "") != (opts.TLSKey == "") {
+		return errors.New("'tls-cert' and 'tls-key' must be set together")
+	}
+	if opts.TLSCert != "" {
+		_, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return fmt.Errorf("loading TLS certificate: %v", err.Error())
+		}
+	}
+	err := validateTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	if opts.DBDriver != "sqlite3" {
+		return fmt.Errorf("unsupported database driver '%v'", opts.DBDriver)
+	}
+	if opts.DBDSN == "" {
+		return errors.New("'db-dsn' must not be empty")
+	}
+
+	switch opts.Backend {
+	case "local":
+		info, err := os.Stat(opts.LocalStorageDir)
+		if err != nil {
+			return fmt.Errorf("local storage directory: %v", err.Error())
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("local storage directory '%v' is not a directory", opts.LocalStorageDir)
+		}
+	default:
+		return fmt.Errorf("unknown file backend '%v'", opts.Backend)
+	}
+
+	_, err = os.Stat(path.Join(opts.StaticDir, "images.html"))
+	if err != nil {
+		return fmt.Errorf("static directory: %v", err.Error())
+	}
+
+	if opts.RequestLogSize < 1 {
+		return errors.New("'request-log-size' must be positive")
+	}
+	if opts.EventMaxAge < 0 || opts.EventMaxCount < 0 {
+		return errors.New("event retention limits must not be negative")
+	}
+	if (opts.EventMaxAge > 0 || opts.EventMaxCount > 0) && opts.EventRetentionInterval <= 0 {
+		return errors.New("'event-retention-interval' must be positive when event retention is enabled")
+	}
+	if opts.MirrorSyncInterval <= 0 || opts.UpstreamSyncInterval <= 0 {
+		return errors.New("mirror and upstream sync intervals must be positive")
+	}
+	if opts.FetchTimeout <= 0 || opts.UploadTimeout <= 0 {
+		return errors.New("fetch and upload timeouts must be positive")
+	}
+	if opts.FetchMaxSize < 1 {
+		return errors.New("'fetch-max-size' must be positive")
+	}
+	if opts.EventQueueSize < 1 || opts.EventBatchSize < 1 || opts.EventFlushInterval <= 0 {
+		return errors.New("event queue size, batch size and flush interval must be positive")
+	}
+
+	_, err = parseTrustedProxies(opts.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if opts.PublicURL != "" {
+		u, err := url.Parse(opts.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid public URL '%v'", opts.PublicURL)
+		}
+	}
+
+	for _, hook := range opts.Webhooks {
+		u, err := url.Parse(hook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL '%v'", hook)
+		}
+	}
+	if opts.ReadHeaderTimeout < 0 || opts.ReadTimeout < 0 || opts.WriteTimeout < 0 || opts.IdleTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if opts.MaxUpdateRequestSize < 1 {
+		return errors.New("'max-update-request-size' must be positive")
+	}
+	if opts.MaxPayloadSize < 1 {
+		return errors.New("'max-payload-size' must be positive")
+	}
+	if opts.UpdateRateLimit < 0 {
+		return errors.New("'update-rate-limit' must not be negative")
+	}
+	if opts.UpdateRateLimit > 0 && opts.UpdateRateBurst < 1 {
+		return errors.New("'update-rate-burst' must be positive when rate limiting is enabled")
+	}
+	if opts.ShutdownTimeout <= 0 {
+		return errors.New("'shutdown-timeout' must be positive")
+	}
+	if opts.WebhookRetries < 0 || opts.WebhookBackoff < 0 {
+		return errors.New("webhook retries and backoff must not be negative")
+	}
+
+	return nil
+}
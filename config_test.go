@@ -0,0 +1,151 @@
+package main
+
+import (
+	flags "github.com/jessevdk/go-flags"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testConfigOptions struct {
+	Port     int           `long:"port" env:"COMAHA_TEST_PORT" default:"8080"`
+	Backoff  time.Duration `long:"backoff" default:"1s"`
+	Debug    bool          `long:"debug"`
+	Webhooks []string      `long:"webhook"`
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "comaha-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := path.Join(dir, "comaha.yaml")
+	err = ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func TestConfigFile(t *testing.T) {
+	filename := writeTestConfig(t, `
+port: 9000
+backoff: 5s
+debug: true
+webhook:
+  - http://a.example.com/
+  - http://b.example.com/
+apps:
+  - id: "{app}"
+    name: Example
+    default_channel: stable
+mirrors:
+  - name: eu
+    url: https://eu.example.com/comaha/
+    dir: /srv/mirror-eu
+    networks: [10.1.0.0/16]
+upstreams:
+  - name: coreos
+    url: https://public.update.core-os.net/v1/update/
+    channels:
+      stable: coreos-stable
+`)
+	defer os.RemoveAll(path.Dir(filename))
+
+	var o testConfigOptions
+	parser := flags.NewParser(&o, flags.None)
+
+	sections, err := loadConfigFile(parser, filename)
+	if err != nil {
+		t.Fatalf("loadConfigFile: %v", err.Error())
+	}
+
+	expectedApps := []appConfig{{ID: "{app}", Name: "Example", DefaultChannel: "stable"}}
+	if !reflect.DeepEqual(sections.Apps, expectedApps) {
+		t.Errorf("Expected apps %+v, got %+v", expectedApps, sections.Apps)
+	}
+	expectedMirrors := []mirrorConfig{{Name: "eu", URL: "https://eu.example.com/comaha/", Dir: "/srv/mirror-eu", Networks: []string{"10.1.0.0/16"}}}
+	if !reflect.DeepEqual(sections.Mirrors, expectedMirrors) {
+		t.Errorf("Expected mirrors %+v, got %+v", expectedMirrors, sections.Mirrors)
+	}
+	expectedUpstreams := []upstreamConfig{{Name: "coreos", URL: "https://public.update.core-os.net/v1/update/", Channels: map[string]string{"stable": "coreos-stable"}}}
+	if !reflect.DeepEqual(sections.Upstreams, expectedUpstreams) {
+		t.Errorf("Expected upstreams %+v, got %+v", expectedUpstreams, sections.Upstreams)
+	}
+
+	// flags override the file, the remaining settings come from it
+	_, err = parser.ParseArgs([]string{"--backoff", "2s"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err.Error())
+	}
+
+	if o.Port != 9000 || o.Backoff != 2*time.Second || !o.Debug {
+		t.Errorf("Unexpected options %+v", o)
+	}
+	if !reflect.DeepEqual(o.Webhooks, []string{"http://a.example.com/", "http://b.example.com/"}) {
+		t.Errorf("Unexpected webhooks %v", o.Webhooks)
+	}
+
+	// environment variables override the file as well
+	os.Setenv("COMAHA_TEST_PORT", "9001")
+	defer os.Unsetenv("COMAHA_TEST_PORT")
+
+	o = testConfigOptions{}
+	parser = flags.NewParser(&o, flags.None)
+	_, err = loadConfigFile(parser, filename)
+	if err != nil {
+		t.Fatalf("loadConfigFile: %v", err.Error())
+	}
+	_, err = parser.ParseArgs(nil)
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err.Error())
+	}
+	if o.Port != 9001 {
+		t.Errorf("Expected port 9001 from the environment, got %v", o.Port)
+	}
+}
+
+func TestConfigFileUnknownSetting(t *testing.T) {
+	filename := writeTestConfig(t, "prot: 9000\n")
+	defer os.RemoveAll(path.Dir(filename))
+
+	var o testConfigOptions
+	_, err := loadConfigFile(flags.NewParser(&o, flags.None), filename)
+	if err == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+}
+
+func TestConfigFileName(t *testing.T) {
+	name := configFileName([]string{"-P", "9000", "--config", "/etc/comaha.yaml", "--debug"})
+	if name != "/etc/comaha.yaml" {
+		t.Errorf("Expected '/etc/comaha.yaml', got '%v'", name)
+	}
+}
+
+func TestSetApps(t *testing.T) {
+	defer func(old map[string]appConfig) { apps = old }(apps)
+
+	err := setApps([]appConfig{{ID: "{a}"}, {ID: "{a}"}})
+	if err == nil {
+		t.Error("Expected an error for a duplicate app")
+	}
+
+	err = setApps([]appConfig{{Name: "no id"}})
+	if err == nil {
+		t.Error("Expected an error for an app without ID")
+	}
+
+	err = setApps([]appConfig{{ID: "{a}", DefaultChannel: "beta"}})
+	if err != nil {
+		t.Fatalf("setApps: %v", err.Error())
+	}
+	if _, ok := apps[coreOSAppID]; ok || apps["{a}"].DefaultChannel != "beta" {
+		t.Errorf("Unexpected apps %+v", apps)
+	}
+}
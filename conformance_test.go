@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/kdomanski/comaha/file-backends/local"
+	"github.com/kdomanski/comaha/simulator"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// Drives the complete server through its router, talking to it like
+// update_engine does.
+type conformanceServer struct {
+	*httptest.Server
+	t *testing.T
+}
+
+func newConformanceServer(t *testing.T) (*conformanceServer, func()) {
+	oldOpts, oldDB, oldFileBE, oldLimiter, oldMirrors := opts, db, fileBE, updateLimiter, mirrors
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+
+	opts.LocalStorageDir, err = ioutil.TempDir("", "comaha-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileBE = local.New(opts.LocalStorageDir)
+	opts.MaxUpdateRequestSize = 262144
+	opts.MaxPayloadSize = 1 << 20
+	opts.RequestLogSize = 1000
+	opts.AdminToken = ""
+	opts.PublicURL = ""
+	updateLimiter = nil
+	mirrors = nil
+
+	s := &conformanceServer{Server: httptest.NewServer(newRouter()), t: t}
+
+	return s, func() {
+		s.Close()
+		db.Close()
+		os.RemoveAll(opts.LocalStorageDir)
+		opts, db, fileBE, updateLimiter, mirrors = oldOpts, oldDB, oldFileBE, oldLimiter, oldMirrors
+	}
+}
+
+func (s *conformanceServer) machine(version, track string) *simulator.Machine {
+	return simulator.NewMachine(s.URL, version, track)
+}
+
+func payloadHashes(data []byte) (string, string) {
+	rawSha1 := sha1.Sum(data)
+	rawSha256 := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(rawSha1[:]), base64.StdEncoding.EncodeToString(rawSha256[:])
+}
+
+func (s *conformanceServer) upload(endpoint string, data []byte, params url.Values) {
+	sha1, sha256 := payloadHashes(data)
+	params.Set("sha1", sha1)
+	params.Set("sha256", sha256)
+
+	resp, err := http.Post(s.URL+endpoint+"?"+params.Encode(), "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		s.t.Fatalf("%v: %v %s", endpoint, resp.StatusCode, body)
+	}
+}
+
+// upload a payload through the admin API and return its ID
+func (s *conformanceServer) addPayload(version, channel string, data []byte) string {
+	s.upload("/admin/add_payload", data, url.Values{"version": {version}, "channel": {channel}})
+
+	images, err := db.ListImages(channel)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for _, image := range images {
+		if image.Version == version {
+			return image.ID
+		}
+	}
+	s.t.Fatalf("Payload %v not found in channel %v", version, channel)
+	return ""
+}
+
+// upload a delta through the admin API and return its ID
+func (s *conformanceServer) addDelta(source, target string, data []byte) string {
+	s.upload("/admin/add_delta", data, url.Values{"source_version": {source}, "target": {target}})
+
+	deltas, err := db.ListDeltas(target)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for _, d := range deltas {
+		if d.SourceVersion == source {
+			return d.ID
+		}
+	}
+	s.t.Fatalf("Delta from %v to %v not found", source, target)
+	return ""
+}
+
+func (s *conformanceServer) lastRequest(machineID string) ClientRequest {
+	requests, err := db.GetRequests(machineID, 1)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		s.t.Fatalf("No request recorded for machine %v", machineID)
+	}
+	return requests[0]
+}
+
+// the single app of a response to machine 'm'
+func responseApp(t *testing.T, m *simulator.Machine, req *omaha.Request) *omaha.App {
+	resp, err := m.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Protocol != "3.0" || len(resp.Apps) != 1 {
+		t.Fatalf("Expected protocol 3.0 and one app, got %+v", resp)
+	}
+	return resp.Apps[0]
+}
+
+func TestConformanceNoUpdate(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+
+	m := s.machine("766.4.0", "stable")
+	req, app := m.NewRequest()
+	app.AddPing()
+	app.AddUpdateCheck()
+
+	respApp := responseApp(t, m, req)
+	if respApp.Status != "ok" || respApp.Id != simulator.CoreOSAppID {
+		t.Errorf("Unexpected app in response: %+v", respApp)
+	}
+	if respApp.UpdateCheck == nil || respApp.UpdateCheck.Status != "noupdate" {
+		t.Errorf("Expected 'noupdate', got %+v", respApp.UpdateCheck)
+	}
+	if respApp.Ping == nil || respApp.Ping.Status != "ok" {
+		t.Errorf("Expected the ping to be acknowledged, got %+v", respApp.Ping)
+	}
+
+	record := s.lastRequest(m.MachineID)
+	if record.Version != "766.4.0" || record.Track != "stable" || record.BootID != m.BootID ||
+		!record.UpdateCheck || !record.Ping || record.Status != "noupdate" || record.OfferedID != "" {
+		t.Errorf("Unexpected request record: %+v", record)
+	}
+}
+
+func TestConformanceUpdateLifecycle(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+
+	data := []byte("full image of 800.0.0")
+	id := s.addPayload("800.0.0", "stable", data)
+
+	m := s.machine("766.4.0", "stable")
+
+	update, err := m.CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil {
+		t.Fatal("Expected an update")
+	}
+	sha1, sha256 := payloadHashes(data)
+	expected := simulator.Update{
+		ID:      id,
+		Version: "800.0.0",
+		URLs:    []string{s.URL + "/file?id=" + id},
+		SHA1:    sha1,
+		SHA256:  sha256,
+		Size:    int64(len(data)),
+	}
+	if !reflect.DeepEqual(*update, expected) {
+		t.Errorf("Expected update %+v, got %+v", expected, *update)
+	}
+
+	record := s.lastRequest(m.MachineID)
+	if record.Status != "ok" || record.OfferedID != id || record.OfferedVersion != "800.0.0" {
+		t.Errorf("Unexpected request record: %+v", record)
+	}
+	if offer, _ := db.GetMachineOffer(m.MachineID); offer != id {
+		t.Errorf("Expected offer %v to be stored, got '%v'", id, offer)
+	}
+
+	downloaded, err := m.Download(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Error("Downloaded data differs from the payload")
+	}
+
+	// the events of the update, previous version sent after the reboot only
+	steps := []struct {
+		evType, evResult int
+		reboot           bool
+	}{
+		{simulator.EventTypeDownload, simulator.EventResultOK, false},
+		{simulator.EventTypeArrive, simulator.EventResultOK, false},
+		{simulator.EventTypeApply, simulator.EventResultOK, false},
+		{simulator.EventTypeApply, simulator.EventResultDone, true},
+	}
+	for _, step := range steps {
+		if step.reboot {
+			m.Reboot(update.Version)
+		}
+		err = m.ReportEvent(step.evType, step.evResult, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := db.GetEvents(EventFilter{MachineID: m.MachineID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(steps) {
+		t.Fatalf("Expected %v events, got %+v", len(steps), events)
+	}
+	for _, ev := range events {
+		if ev.PayloadID != id || ev.Channel != "stable" {
+			t.Errorf("Event not attributed to payload %v in 'stable': %+v", id, ev)
+		}
+		switch ev.Result {
+		case eventResultDone:
+			if ev.Version != "800.0.0" || ev.PreviousVersion != "766.4.0" {
+				t.Errorf("Unexpected versions in completion event: %+v", ev)
+			}
+		default:
+			if ev.Version != "766.4.0" || ev.PreviousVersion != "" {
+				t.Errorf("Unexpected versions in event: %+v", ev)
+			}
+		}
+	}
+
+	stats, err := db.GetReleaseStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Machines != 1 || stats[0].Downloads != 1 || stats[0].Applied != 1 ||
+		stats[0].Completed != 1 || stats[0].Failed != 0 {
+		t.Errorf("Unexpected release stats: %+v", stats)
+	}
+
+	// up to date after the update
+	update, err = m.CheckForUpdate()
+	if err != nil || update != nil {
+		t.Errorf("Expected no further update, got %+v, %v", update, err)
+	}
+}
+
+func TestConformanceSimulatedUpdate(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+
+	s.addPayload("800.0.0", "beta", []byte("800.0.0"))
+	s.addPayload("766.4.0", "stable", []byte("766.4.0"))
+
+	m := s.machine("700.0.0", "beta")
+	update, err := m.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil || m.Version != "800.0.0" || m.PreviousVersion != "" {
+		t.Fatalf("Expected the machine to run 800.0.0, got %v after %+v", m.Version, update)
+	}
+
+	update, err = m.Update()
+	if err != nil || update != nil {
+		t.Errorf("Expected no further update, got %+v, %v", update, err)
+	}
+}
+
+func TestConformanceMirrors(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+
+	mirrorDir, err := ioutil.TempDir("", "comaha-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mirrorDir)
+
+	downloads := 0
+	files := http.StripPrefix("/payloads", http.FileServer(http.Dir(mirrorDir)))
+	mirrorServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		files.ServeHTTP(w, r)
+	}))
+	defer mirrorServer.Close()
+
+	// the test clients connect from the loopback network
+	err = setMirrors([]mirrorConfig{{Name: "loopback", URL: mirrorServer.URL + "/payloads", Dir: mirrorDir, Networks: []string{"127.0.0.0/8", "::1"}}})
+	if err != nil {
+		t.Fatalf("setMirrors: %v", err.Error())
+	}
+
+	data := []byte("full image of 800.0.0")
+	id := s.addPayload("800.0.0", "stable", data)
+	m := s.machine("766.4.0", "stable")
+
+	// not advertised before the payload is replicated
+	update, err := m.CheckForUpdate()
+	if err != nil || update == nil {
+		t.Fatalf("Expected an update, got %v", err)
+	}
+	if len(update.URLs) != 1 {
+		t.Errorf("Expected only the server's URL, got %v", update.URLs)
+	}
+
+	mirrors[0].sync(make(chan struct{}))
+
+	update, err = m.CheckForUpdate()
+	if err != nil || update == nil {
+		t.Fatalf("Expected an update, got %v", err)
+	}
+	expected := []string{mirrorServer.URL + "/payloads/" + id, s.URL + "/file?id=" + id}
+	if !reflect.DeepEqual(update.URLs, expected) {
+		t.Errorf("Expected URLs %v, got %v", expected, update.URLs)
+	}
+
+	downloaded, err := m.Download(update)
+	if err != nil || !bytes.Equal(downloaded, data) || downloads != 1 {
+		t.Errorf("Expected the payload to be downloaded from the mirror, got %v after %v mirror requests", err, downloads)
+	}
+
+	// clients fall back to the server when the mirror fails
+	os.Remove(path.Join(mirrorDir, id))
+	downloaded, err = m.Download(update)
+	if err != nil || !bytes.Equal(downloaded, data) || downloads != 2 {
+		t.Errorf("Expected the payload to be downloaded from the server, got %v after %v mirror requests", err, downloads)
+	}
+}
+
+func TestConformanceFailedUpdate(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+
+	id := s.addPayload("800.0.0", "stable", []byte("800.0.0"))
+
+	m := s.machine("766.4.0", "stable")
+	if _, err := m.CheckForUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	err := m.ReportEvent(simulator.EventTypeApply, simulator.EventResultError, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := db.GetEvents(EventFilter{MachineID: m.MachineID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ErrorCode != 7 || events[0].PayloadID != id {
+		t.Errorf("Expected the failure with error code 7 to be recorded, got %+v", events)
+	}
+
+	stats, err := db.GetReleaseStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Failed != 1 || stats[0].Completed != 0 {
+		t.Errorf("Unexpected release stats: %+v", stats)
+	}
+}
+
+func TestConformanceDelta(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+
+	target := s.addPayload("800.0.0", "stable", []byte("full image"))
+	deltaData := []byte("delta from 766.4.0")
+	deltaID := s.addDelta("766.4.0", target, deltaData)
+
+	m := s.machine("766.4.0", "stable")
+	update, err := m.CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil || !update.IsDelta || update.ID != deltaID || update.Version != "800.0.0" || update.Size != int64(len(deltaData)) {
+		t.Fatalf("Expected delta %v, got %+v", deltaID, update)
+	}
+	if _, err = m.Download(update); err != nil {
+		t.Error(err)
+	}
+
+	// other versions get the full image
+	update, err = s.machine("700.0.0", "stable").CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil || update.IsDelta || update.ID != target {
+		t.Errorf("Expected the full image %v, got %+v", target, update)
+	}
+}
+
+func TestConformanceDefaultChannel(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+
+	defer func(old map[string]appConfig) { apps = old }(apps)
+	apps = map[string]appConfig{
+		coreOSAppID: {ID: coreOSAppID, Name: "CoreOS", DefaultChannel: "beta"},
+	}
+
+	id := s.addPayload("800.0.0", "beta", []byte("800.0.0"))
+
+	m := s.machine("766.4.0", "")
+	update, err := m.CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil || update.ID != id {
+		t.Errorf("Expected the default channel's payload %v, got %+v", id, update)
+	}
+	if record := s.lastRequest(m.MachineID); record.Track != "beta" {
+		t.Errorf("Expected the default channel to be recorded, got '%v'", record.Track)
+	}
+}
+
+func TestConformanceErrors(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+
+	// unknown application
+	m := s.machine("766.4.0", "stable")
+	m.AppID = "{00000000-0000-0000-0000-000000000000}"
+	req, app := m.NewRequest()
+	app.AddUpdateCheck()
+	if respApp := responseApp(t, m, req); respApp.Status != "error-unknownApplication" || respApp.Id != m.AppID {
+		t.Errorf("Expected 'error-unknownApplication', got %+v", respApp)
+	}
+
+	// unparseable version
+	m = s.machine("not-a-version", "stable")
+	req, app = m.NewRequest()
+	app.AddUpdateCheck()
+	respApp := responseApp(t, m, req)
+	if respApp.UpdateCheck == nil || respApp.UpdateCheck.Status != "error-invalidVersionString" {
+		t.Errorf("Expected 'error-invalidVersionString', got %+v", respApp.UpdateCheck)
+	}
+
+	// a ping alone is acknowledged without an update check
+	m = s.machine("766.4.0", "stable")
+	req, app = m.NewRequest()
+	app.AddPing()
+	respApp = responseApp(t, m, req)
+	if respApp.UpdateCheck != nil || respApp.Ping == nil || respApp.Ping.Status != "ok" {
+		t.Errorf("Expected only a ping in the response, got %+v", respApp)
+	}
+	if err := m.Ping(); err != nil {
+		t.Error(err)
+	}
+
+	// files are only served for known payloads
+	_, err := m.Download(&simulator.Update{URLs: []string{s.URL + "/file?id=unknown"}})
+	if serr, ok := err.(*simulator.StatusError); !ok || serr.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for an unknown file, got %v", err)
+	}
+
+	// malformed requests get an Omaha error
+	resp, err := http.Post(s.URL+"/update", "text/xml", bytes.NewReader([]byte("<request")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !bytes.Contains(body, []byte(fmt.Sprintf("status=%q", "error-invalidRequest"))) {
+		t.Errorf("Expected an Omaha error response, got %v %s", resp.StatusCode, body)
+	}
+}
@@ -1,19 +1,48 @@
 package main
 
+import "time"
+
 type userDB interface {
 	AddPayload(id, sha1, sha256 string, size int64, version payloadVersion) error
 	DeletePayload(id, channel string) error
 	AttachPayloadToChannel(id, channel string) error
+	YankPayload(id, channel, reason string, downgrade bool) error
+	UnyankPayload(id, channel string) error
 	GetNewerPayload(currentVersion payloadVersion, channel string) (*payload, error)
 	PayloadExists(id string) bool
+	FileExists(id string) (bool, error)
+	ListFileIDs() ([]string, error)
+	SetPayloadMinSourceVersion(id string, version *payloadVersion) error
+	SetPayloadRequiredStop(id string, value bool) error
+
+	AddDelta(id, sha1, sha256 string, size int64, source payloadVersion, target string) error
+	DeleteDelta(id string) error
+	GetDelta(source payloadVersion, target string) (*delta, error)
+	ListDeltas(target string) ([]delta, error)
 
 	ListImages(channel string) ([]payload, error)
 	ListChannels() ([]string, error)
 	GetChannelForceDowngrade(channel string) (bool, error)
 	SetChannelForceDowngrade(channel string, value bool) error
 
-	GetEvents() ([]Event, error)
-	LogEvent(client string, evType, evResult int) error
+	CountEvents(filter EventFilter) (int, error)
+	GetEvents(filter EventFilter) ([]Event, error)
+	LogEvent(ev Event) error
+	LogEvents(evs []Event) error
+	GetReleaseStats() ([]ReleaseStats, error)
+	CompactEvents(maxAge time.Duration, maxCount int) (int64, error)
+	GetEventAggregates(channel string) ([]EventAggregate, error)
+
+	GetMachineOffer(machineID string) (string, error)
+	SetMachineOffer(machineID, payloadID string) error
+
+	GetRequests(machineID string, limit int) ([]ClientRequest, error)
+	ListMachines() ([]Machine, error)
+	LogRequest(req ClientRequest, keep int) error
+
+	AddWebhookDeadLetter(url, body, reason string) error
+	GetWebhookDeadLetters() ([]WebhookDeadLetter, error)
 
+	Ping() error
 	Close() error
 }
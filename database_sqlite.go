@@ -2,29 +2,138 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 )
 
-// sqlite3 cannot use a single connection concurrently - thus the mutex
+// Writes go through a single connection, as sqlite admits only one writer at
+// a time anyway. In WAL mode reads do not block on writes and run concurrently
+// on a pool of their own connections.
 type sqliteDB struct {
-	db    *sql.DB
-	mutex sync.Mutex
+	writer *sql.DB
+	// the same as writer for in-memory databases, which are private to their connection
+	reader *sql.DB
+
+	stmtMutex sync.Mutex
+	stmts     map[stmtKey]*sql.Stmt
+
+	// answers update checks without querying the database; every change
+	// to payloads, deltas or channel settings invalidates it
+	cache *channelCache
+}
+
+type stmtKey struct {
+	handle *sql.DB
+	query  string
 }
 
 func newSqliteDB(filename string) (*sqliteDB, error) {
-	database, err := sql.Open("sqlite3", filename)
+	writer, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	writer.SetMaxOpenConns(1)
+
+	err = initStructure(writer)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	u := &sqliteDB{writer: writer, reader: writer, stmts: make(map[stmtKey]*sql.Stmt), cache: newChannelCache()}
+	if isMemoryDSN(filename) {
+		return u, nil
+	}
+
+	var journalMode string
+	err = writer.QueryRow("PRAGMA journal_mode=WAL;").Scan(&journalMode)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if journalMode != "wal" {
+		log.Warnf("DB: could not enable WAL mode, journal mode is '%v'; reads will wait for writes", journalMode)
+	}
+
+	u.reader, err = sql.Open("sqlite3", filename)
 	if err != nil {
+		writer.Close()
 		return nil, err
 	}
+	u.reader.SetMaxOpenConns(sqliteReaders())
+	u.reader.SetMaxIdleConns(sqliteReaders())
+
+	return u, nil
+}
+
+// size of the pool of reading connections
+func sqliteReaders() int {
+	n := 2 * runtime.NumCPU()
+	if n < 4 {
+		n = 4
+	}
+	return n
+}
+
+func isMemoryDSN(dsn string) bool {
+	return dsn == ":memory:" || strings.HasPrefix(dsn, "file::memory:") || strings.Contains(dsn, "mode=memory")
+}
+
+// a statement prepared once per handle and query
+func (u *sqliteDB) prepare(handle *sql.DB, query string) (*sql.Stmt, error) {
+	key := stmtKey{handle, query}
+
+	u.stmtMutex.Lock()
+	stmt, ok := u.stmts[key]
+	u.stmtMutex.Unlock()
+	if ok {
+		return stmt, nil
+	}
 
-	err = initStructure(database)
+	// prepared without holding the lock, the writer may be busy
+	stmt, err := handle.Prepare(query)
 	if err != nil {
 		return nil, err
 	}
 
-	return &sqliteDB{db: database}, nil
+	u.stmtMutex.Lock()
+	defer u.stmtMutex.Unlock()
+	if existing, ok := u.stmts[key]; ok {
+		stmt.Close()
+		return existing, nil
+	}
+	u.stmts[key] = stmt
+
+	return stmt, nil
+}
+
+func (u *sqliteDB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := u.prepare(u.reader, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+func (u *sqliteDB) queryRow(query string, args ...interface{}) *sql.Row {
+	stmt, err := u.prepare(u.reader, query)
+	if err != nil {
+		// the error surfaces in Scan
+		return u.reader.QueryRow(query, args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
+func (u *sqliteDB) exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := u.prepare(u.writer, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
 }
 
 func initStructure(database *sql.DB) error {
@@ -33,11 +142,41 @@ func initStructure(database *sql.DB) error {
 		return err
 	}
 
+	err = addColumnIfMissing(database, "payloads", "min_source_version", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(database, "payloads", "required_stop", "INTEGER DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("CREATE TABLE IF NOT EXISTS deltas(id TEXT, target TEXT, size INTEGER, sha1 TEXT, sha256 TEXT, src_build INTEGER, src_branch INTEGER, src_patch INTEGER, src_timestamp INTEGER)")
+	if err != nil {
+		return err
+	}
+
 	_, err = database.Exec("CREATE TABLE IF NOT EXISTS channel_payload_rel(payload TEXT, channel TEXT)")
 	if err != nil {
 		return err
 	}
 
+	err = addColumnIfMissing(database, "channel_payload_rel", "yanked", "INTEGER DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(database, "channel_payload_rel", "yank_reason", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(database, "channel_payload_rel", "yank_downgrade", "INTEGER DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
 	_, err = database.Exec("CREATE TABLE IF NOT EXISTS client(id TEXT, name TEXT)")
 	if err != nil {
 		return err
@@ -53,29 +192,70 @@ func initStructure(database *sql.DB) error {
 		return err
 	}
 
-	_, err = database.Exec("CREATE TABLE IF NOT EXISTS channel_settings(channel TEXT, force_downgrade INTEGER DEFAULT 0)")
+	err = addColumnIfMissing(database, "events", "channel", "TEXT DEFAULT ''")
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	err = addColumnIfMissing(database, "events", "version", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
 
-func (u *sqliteDB) Close() error {
-	return u.db.Close()
-}
+	err = addColumnIfMissing(database, "events", "previous_version", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
 
-func (u *sqliteDB) AttachPayloadToChannel(id, channel string) error {
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
+	err = addColumnIfMissing(database, "events", "payload", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(database, "events", "error_code", "INTEGER DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec(`CREATE TABLE IF NOT EXISTS event_aggregates(day INTEGER, channel TEXT, version TEXT, payload TEXT, type INTEGER, result INTEGER, count INTEGER,
+		UNIQUE(day, channel, version, payload, type, result))`)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("CREATE TABLE IF NOT EXISTS webhook_dead_letters(url TEXT, body TEXT, reason TEXT, timestamp INTEGER)")
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("CREATE TABLE IF NOT EXISTS machine_offers(client TEXT PRIMARY KEY, payload TEXT, timestamp INTEGER)")
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("CREATE INDEX IF NOT EXISTS events_timestamp ON events(timestamp)")
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("CREATE INDEX IF NOT EXISTS events_client ON events(client, timestamp)")
+	if err != nil {
+		return err
+	}
 
-	q, err := u.db.Prepare(`INSERT INTO channel_payload_rel (payload,channel) SELECT ?, ?
-	                        WHERE NOT EXISTS(SELECT 1 FROM channel_payload_rel WHERE payload=? AND channel=?);`)
+	_, err = database.Exec(`CREATE TABLE IF NOT EXISTS requests(client TEXT, timestamp INTEGER, remote_addr TEXT, app_id TEXT, version TEXT, track TEXT,
+		os_platform TEXT, os_version TEXT, os_sp TEXT, os_arch TEXT, oem TEXT, oem_version TEXT, boot_id TEXT,
+		update_check INTEGER, ping INTEGER, events INTEGER, status TEXT, offered_id TEXT, offered_version TEXT)`)
 	if err != nil {
 		return err
 	}
 
-	_, err = q.Exec(id, channel, id, channel)
+	_, err = database.Exec("CREATE INDEX IF NOT EXISTS requests_client ON requests(client, timestamp)")
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("CREATE TABLE IF NOT EXISTS channel_settings(channel TEXT, force_downgrade INTEGER DEFAULT 0)")
 	if err != nil {
 		return err
 	}
@@ -83,14 +263,71 @@ func (u *sqliteDB) AttachPayloadToChannel(id, channel string) error {
 	return nil
 }
 
-func (u *sqliteDB) AddPayload(id, sha1, sha256 string, size int64, version payloadVersion) error {
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
-	q, err := u.db.Prepare("INSERT INTO payloads (id,size,sha1,sha256,ver_build,ver_branch,ver_patch,ver_timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?);")
+// databases created by older versions lack some columns - add them in place
+func addColumnIfMissing(database *sql.DB, table, column, definition string) error {
+	rows, err := database.Query(fmt.Sprintf("PRAGMA table_info(%v);", table))
 	if err != nil {
 		return err
 	}
-	_, err = q.Exec(id, size, sha1, sha256, version.build, version.branch, version.patch, version.timestamp.Unix())
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = database.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v;", table, column, definition))
+	return err
+}
+
+// check that the database can be queried
+func (u *sqliteDB) Ping() error {
+	var n int
+	return u.queryRow("SELECT count(*) FROM channel_payload_rel;").Scan(&n)
+}
+
+// waits for running queries, if any
+func (u *sqliteDB) Close() error {
+	u.stmtMutex.Lock()
+	for key, stmt := range u.stmts {
+		stmt.Close()
+		delete(u.stmts, key)
+	}
+	u.stmtMutex.Unlock()
+
+	if u.reader != u.writer {
+		u.reader.Close()
+	}
+	return u.writer.Close()
+}
+
+func (u *sqliteDB) AttachPayloadToChannel(id, channel string) error {
+	defer u.cache.invalidate()
+
+	_, err := u.exec(`INSERT INTO channel_payload_rel (payload,channel) SELECT ?, ?
+	                        WHERE NOT EXISTS(SELECT 1 FROM channel_payload_rel WHERE payload=? AND channel=?);`,
+		id, channel, id, channel)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (u *sqliteDB) AddPayload(id, sha1, sha256 string, size int64, version payloadVersion) error {
+	defer u.cache.invalidate()
+
+	_, err := u.exec("INSERT INTO payloads (id,size,sha1,sha256,ver_build,ver_branch,ver_patch,ver_timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
+		id, size, sha1, sha256, version.build, version.branch, version.patch, version.timestamp.Unix())
 	if err != nil {
 		return err
 	}
@@ -101,15 +338,17 @@ func (u *sqliteDB) AddPayload(id, sha1, sha256 string, size int64, version paylo
 }
 
 func (u *sqliteDB) DeletePayload(id, channel string) error {
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
-	tx, err := u.db.Begin()
+	defer u.cache.invalidate()
+
+	tx, err := u.writer.Begin()
 	if err != nil {
 		return err
 	}
 
+	// a transaction left open would block all further writes
 	_, err = tx.Exec("DELETE from channel_payload_rel WHERE payload=? AND channel=?;", id, channel)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
@@ -117,68 +356,281 @@ func (u *sqliteDB) DeletePayload(id, channel string) error {
     AND NOT EXISTS(SELECT 1 FROM channel_payload_rel WHERE payload=?);`,
 		id, id)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
 	return tx.Commit()
 }
 
+func (u *sqliteDB) AddDelta(id, sha1, sha256 string, size int64, source payloadVersion, target string) error {
+	defer u.cache.invalidate()
+
+	_, err := u.exec("INSERT INTO deltas (id,target,size,sha1,sha256,src_build,src_branch,src_patch,src_timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);",
+		id, target, size, sha1, sha256, source.build, source.branch, source.patch, source.timestamp.Unix())
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("DB: added delta '%v' from %v to payload '%v', size=%v, sha1=%v, sha256=%v", id, source.String(), target, size, sha1, sha256)
+
+	return nil
+}
+
+// returns sql.ErrNoRows if 'id' is not a delta
+func (u *sqliteDB) DeleteDelta(id string) error {
+	defer u.cache.invalidate()
+
+	result, err := u.exec("DELETE FROM deltas WHERE id=?;", id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (u *sqliteDB) GetDelta(source payloadVersion, target string) (*delta, error) {
+	deltas, err := u.cache.deltasTo(target, func() ([]delta, error) {
+		return u.ListDeltas(target)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sourceVersion := source.String()
+	for _, d := range deltas {
+		if d.SourceVersion == sourceVersion {
+			result := d
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (u *sqliteDB) ListDeltas(target string) ([]delta, error) {
+	result, err := u.query(`SELECT id,size,sha1,sha256,src_build,src_branch,src_patch,src_timestamp FROM deltas
+		WHERE target=? ORDER BY src_build, src_branch, src_patch, src_timestamp;`, target)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	out := []delta{}
+
+	for result.Next() {
+		d := delta{Target: target}
+
+		var source payloadVersion
+		var timestamp int64
+
+		err = result.Scan(&d.ID, &d.Size, &d.SHA1, &d.SHA256, &source.build, &source.branch, &source.patch, &timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		source.timestamp = time.Unix(timestamp, 0).UTC()
+		d.SourceVersion = source.String()
+		out = append(out, d)
+	}
+
+	return out, nil
+}
+
 func (u *sqliteDB) PayloadExists(id string) bool {
-	row := u.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM payloads WHERE id=?);`, id)
+	row := u.queryRow(`SELECT EXISTS(SELECT 1 FROM payloads WHERE id=?);`, id)
 	var result int64
 	row.Scan(&result)
 
 	return result > 0
 }
 
-func (u *sqliteDB) GetNewerPayload(currentVersion payloadVersion, channel string) (*payload, error) {
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
+// whether 'id' is a stored payload or delta, i.e. may be downloaded
+func (u *sqliteDB) FileExists(id string) (bool, error) {
+	var result int64
+	err := u.queryRow(`SELECT EXISTS(SELECT 1 FROM payloads WHERE id=?) OR EXISTS(SELECT 1 FROM deltas WHERE id=?);`, id, id).Scan(&result)
+	if err != nil {
+		return false, err
+	}
 
-	q, err := u.db.Prepare(`SELECT id,size,sha1,sha256,ver_build,ver_branch,ver_patch,ver_timestamp,ifnull(force_downgrade,0) FROM payloads AS P
-		JOIN channel_payload_rel AS R ON P.id=R.payload
-		LEFT OUTER JOIN channel_settings AS S ON S.channel=R.channel
-		WHERE R.channel=?
-		ORDER BY ver_build DESC, ver_branch DESC, ver_patch DESC, ver_timestamp DESC LIMIT 1;`)
+	return result > 0, nil
+}
+
+// IDs of all stored files, payloads and deltas
+func (u *sqliteDB) ListFileIDs() ([]string, error) {
+	result, err := u.query("SELECT id FROM payloads UNION SELECT id FROM deltas;")
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	ids := []string{}
+
+	for result.Next() {
+		var id string
+		err = result.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func (u *sqliteDB) GetNewerPayload(currentVersion payloadVersion, channel string) (*payload, error) {
+	head, err := u.cache.head(channel, func() (*channelHead, error) {
+		return u.loadChannelHead(channel)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	result := q.QueryRow(channel)
+	p := head.newerPayload(currentVersion)
+	if p == nil {
+		return nil, nil
+	}
+
+	// the cached payload must not be modified
+	result := *p
+	return &result, nil
+}
 
-	var p payload
-	var latest payloadVersion
+// the channel's payloads and settings, as cached for update checks
+func (u *sqliteDB) loadChannelHead(channel string) (*channelHead, error) {
 	var forceDowngrade int
-	var latestTimestamp int64
-	err = result.Scan(&p.ID, &p.Size, &p.SHA1, &p.SHA256, &latest.build, &latest.branch, &latest.patch, &latestTimestamp, &forceDowngrade)
+	row := u.queryRow("SELECT force_downgrade FROM channel_settings WHERE channel=?;", channel)
+	err := row.Scan(&forceDowngrade)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	result, err := u.query(`SELECT id,size,sha1,sha256,ver_build,ver_branch,ver_patch,ver_timestamp,ifnull(min_source_version,''),ifnull(required_stop,0),ifnull(yanked,0),ifnull(yank_reason,''),ifnull(yank_downgrade,0) FROM payloads AS P
+		JOIN channel_payload_rel AS R ON P.id=R.payload
+		WHERE R.channel=?
+		ORDER BY ver_build, ver_branch, ver_patch, ver_timestamp;`, channel)
 	if err != nil {
 		return nil, err
 	}
-	latest.timestamp = time.Unix(latestTimestamp, 0).UTC()
+	defer result.Close()
 
-	if forceDowngrade == 0 {
-		if latest.IsGreater(currentVersion) {
-			return &p, nil
+	images := []chainPayload{}
+
+	for result.Next() {
+		var p chainPayload
+		var timestamp int64
+		var requiredStop, yanked, yankDowngrade int
+		err = result.Scan(&p.ID, &p.Size, &p.SHA1, &p.SHA256, &p.version.build, &p.version.branch, &p.version.patch, &timestamp, &p.MinSourceVersion, &requiredStop, &yanked, &p.YankReason, &yankDowngrade)
+		if err != nil {
+			return nil, err
 		}
-		return nil, nil
+		p.version.timestamp = time.Unix(timestamp, 0).UTC()
+		p.Version = p.version.String()
+		p.RequiredStop = requiredStop != 0
+		p.Yanked = yanked != 0
+		p.YankDowngrade = yankDowngrade != 0
+
+		if p.MinSourceVersion != "" {
+			minSource, err := parseVersionString(p.MinSourceVersion)
+			if err != nil {
+				return nil, fmt.Errorf("payload '%v' has invalid minimum source version: %v", p.ID, err.Error())
+			}
+			p.minSource = &minSource
+		}
+
+		images = append(images, p)
 	}
 
-	// forceDowngrade != 0
-	if latest.IsEqual(currentVersion) == false {
-		return &p, nil
+	return &channelHead{images: images, forceDowngrade: forceDowngrade != 0}, nil
+}
+
+func (u *sqliteDB) SetPayloadMinSourceVersion(id string, version *payloadVersion) error {
+	defer u.cache.invalidate()
+
+	var value string
+	if version != nil {
+		value = version.String()
 	}
 
-	return nil, nil
+	result, err := u.exec("UPDATE payloads SET min_source_version=? WHERE id=?;", value, id)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, id)
 }
 
-func (u *sqliteDB) ListChannels() ([]string, error) {
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
+func (u *sqliteDB) SetPayloadRequiredStop(id string, value bool) error {
+	defer u.cache.invalidate()
 
-	result, err := u.db.Query("SELECT DISTINCT channel FROM channel_payload_rel;")
+	var intValue int
+	if value {
+		intValue = 1
+	}
+
+	result, err := u.exec("UPDATE payloads SET required_stop=? WHERE id=?;", intValue, id)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, id)
+}
+
+func (u *sqliteDB) YankPayload(id, channel, reason string, downgrade bool) error {
+	defer u.cache.invalidate()
+
+	var intDowngrade int
+	if downgrade {
+		intDowngrade = 1
+	}
+
+	result, err := u.exec("UPDATE channel_payload_rel SET yanked=1, yank_reason=?, yank_downgrade=? WHERE payload=? AND channel=?;", reason, intDowngrade, id, channel)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, id)
+}
+
+func (u *sqliteDB) UnyankPayload(id, channel string) error {
+	defer u.cache.invalidate()
+
+	result, err := u.exec("UPDATE channel_payload_rel SET yanked=0, yank_reason='', yank_downgrade=0 WHERE payload=? AND channel=?;", id, channel)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result, id)
+}
+
+// fail if an UPDATE of payload 'id' did not match any row
+func expectAffected(result sql.Result, id string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("no such payload '%v'", id)
+	}
+
+	return nil
+}
+
+func (u *sqliteDB) ListChannels() ([]string, error) {
+	result, err := u.query("SELECT DISTINCT channel FROM channel_payload_rel;")
 	if err != nil {
 		return nil, err
 	}
+	defer result.Close()
 
 	channels := []string{}
 
@@ -195,18 +647,11 @@ func (u *sqliteDB) ListChannels() ([]string, error) {
 }
 
 func (u *sqliteDB) ListImages(channel string) ([]payload, error) {
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
-
-	q, err := u.db.Prepare("SELECT DISTINCT id,ver_build,ver_branch,ver_patch,ver_timestamp,sha1,sha256,size FROM payloads AS P JOIN channel_payload_rel AS R ON P.id=R.payload WHERE R.channel=? ORDER BY ver_build, ver_branch, ver_patch, ver_timestamp;")
-	if err != nil {
-		return nil, err
-	}
-
-	result, err := q.Query(channel)
+	result, err := u.query("SELECT DISTINCT id,ver_build,ver_branch,ver_patch,ver_timestamp,sha1,sha256,size,ifnull(min_source_version,''),ifnull(required_stop,0),ifnull(yanked,0),ifnull(yank_reason,''),ifnull(yank_downgrade,0) FROM payloads AS P JOIN channel_payload_rel AS R ON P.id=R.payload WHERE R.channel=? ORDER BY ver_build, ver_branch, ver_patch, ver_timestamp;", channel)
 	if err != nil {
 		return nil, err
 	}
+	defer result.Close()
 
 	out := []payload{}
 
@@ -215,75 +660,570 @@ func (u *sqliteDB) ListImages(channel string) ([]payload, error) {
 
 		var ver payloadVersion
 		var timestamp int64
+		var requiredStop, yanked, yankDowngrade int
 
-		err = result.Scan(&image.ID, &ver.build, &ver.branch, &ver.patch, &timestamp, &image.SHA1, &image.SHA256, &image.Size)
+		err = result.Scan(&image.ID, &ver.build, &ver.branch, &ver.patch, &timestamp, &image.SHA1, &image.SHA256, &image.Size, &image.MinSourceVersion, &requiredStop, &yanked, &image.YankReason, &yankDowngrade)
 		if err != nil {
 			return nil, err
 		}
 
 		ver.timestamp = time.Unix(timestamp, 0).UTC()
 		image.Version = ver.String()
+		image.RequiredStop = requiredStop != 0
+		image.Yanked = yanked != 0
+		image.YankDowngrade = yankDowngrade != 0
 		out = append(out, image)
 	}
 
 	return out, nil
 }
 
-func (u *sqliteDB) LogEvent(client string, evType, evResult int) error {
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
+func (u *sqliteDB) LogEvent(ev Event) error {
+	return u.LogEvents([]Event{ev})
+}
+
+// store several events in a single transaction
+func (u *sqliteDB) LogEvents(evs []Event) error {
+	insert, err := u.prepare(u.writer, "INSERT INTO events (client,type,result,timestamp,channel,version,previous_version,payload,error_code) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);")
+	if err != nil {
+		return err
+	}
 
-	q, err := u.db.Prepare("INSERT INTO events (client,type,result,timestamp) VALUES (?, ?, ?, ?);")
+	tx, err := u.writer.Begin()
 	if err != nil {
 		return err
 	}
+	stmt := tx.Stmt(insert)
 
-	_, err = q.Exec(client, evType, evResult, time.Now().UTC().Unix())
+	now := time.Now().UTC()
+	for _, ev := range evs {
+		received := ev.received
+		if received.IsZero() {
+			received = now
+		}
 
-	return err
+		_, err = stmt.Exec(ev.MachineID, ev.Type, ev.Result, received.Unix(), ev.Channel, ev.Version, ev.PreviousVersion, ev.PayloadID, ev.ErrorCode)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 type Event struct {
+	MachineID       string
+	Type            int
+	Result          int
+	Timestamp       string
+	Channel         string
+	Version         string
+	PreviousVersion string
+	PayloadID       string
+	ErrorCode       int
+
+	// when the event was reported, the time of storing it if zero
+	received time.Time
+}
+
+// Criteria for selecting events; zero values match everything.
+// Page numbering starts at 1, a zero PerPage means no pagination.
+type EventFilter struct {
 	MachineID string
+	Channel   string
+	Version   string
+	PayloadID string
+	Type      *int
+	Result    *int
+	Since     time.Time
+	Until     time.Time
+
+	Page    int
+	PerPage int
+}
+
+func (f EventFilter) where() (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	if f.MachineID != "" {
+		conditions = append(conditions, "client=?")
+		args = append(args, f.MachineID)
+	}
+	if f.Channel != "" {
+		conditions = append(conditions, "channel=?")
+		args = append(args, f.Channel)
+	}
+	if f.Version != "" {
+		conditions = append(conditions, "version=?")
+		args = append(args, f.Version)
+	}
+	if f.PayloadID != "" {
+		conditions = append(conditions, "payload=?")
+		args = append(args, f.PayloadID)
+	}
+	if f.Type != nil {
+		conditions = append(conditions, "type=?")
+		args = append(args, *f.Type)
+	}
+	if f.Result != nil {
+		conditions = append(conditions, "result=?")
+		args = append(args, *f.Result)
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "timestamp>=?")
+		args = append(args, f.Since.UTC().Unix())
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions, "timestamp<?")
+		args = append(args, f.Until.UTC().Unix())
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// newest events first
+func (u *sqliteDB) GetEvents(filter EventFilter) ([]Event, error) {
+	where, args := filter.where()
+	query := "SELECT client,type,result,timestamp,ifnull(channel,''),ifnull(version,''),ifnull(previous_version,''),ifnull(payload,''),ifnull(error_code,0) FROM events" + where + " ORDER BY timestamp DESC, rowid DESC"
+	if filter.PerPage > 0 {
+		page := filter.Page
+		if page < 1 {
+			page = 1
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.PerPage, (page-1)*filter.PerPage)
+	}
+
+	result, err := u.query(query+";", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	out := []Event{}
+
+	for result.Next() {
+		var ev Event
+
+		var timestamp int64
+
+		err = result.Scan(&ev.MachineID, &ev.Type, &ev.Result, &timestamp, &ev.Channel, &ev.Version, &ev.PreviousVersion, &ev.PayloadID, &ev.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+
+		ev.Timestamp = time.Unix(timestamp, 0).UTC().String()
+		out = append(out, ev)
+	}
+
+	return out, nil
+}
+
+// number of events matching the filter, regardless of pagination
+func (u *sqliteDB) CountEvents(filter EventFilter) (int, error) {
+	where, args := filter.where()
+	row := u.queryRow("SELECT count(*) FROM events"+where+";", args...)
+
+	var count int
+	err := row.Scan(&count)
+	return count, err
+}
+
+// Number of events of one type and result reported on a single day
+// by machines in a channel running a particular version
+type EventAggregate struct {
+	Day       string
+	Channel   string
+	Version   string
+	PayloadID string
 	Type      int
 	Result    int
+	Count     int
+}
+
+// Roll events older than 'maxAge' or beyond the newest 'maxCount' up into
+// daily aggregates and delete them. A zero value disables the respective limit.
+// Returns the number of events removed.
+func (u *sqliteDB) CompactEvents(maxAge time.Duration, maxCount int) (int64, error) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	if maxAge > 0 {
+		conditions = append(conditions, "timestamp<?")
+		args = append(args, time.Now().Add(-maxAge).UTC().Unix())
+	}
+	if maxCount > 0 {
+		// rowids have gaps where events were deleted
+		conditions = append(conditions, "rowid<=(SELECT rowid FROM events ORDER BY rowid DESC LIMIT 1 OFFSET ?)")
+		args = append(args, maxCount)
+	}
+
+	if len(conditions) == 0 {
+		return 0, nil
+	}
+	where := " WHERE " + strings.Join(conditions, " OR ")
+
+	tx, err := u.writer.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(`SELECT timestamp/86400*86400 AS day, ifnull(channel,''), ifnull(version,''), ifnull(payload,''), type, result, count(*) FROM events`+where+`
+		GROUP BY day, channel, version, payload, type, result;`, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	type aggregateRow struct {
+		day                       int64
+		channel, version, payload string
+		evType, evResult, count   int
+	}
+
+	aggregates := []aggregateRow{}
+	for rows.Next() {
+		var a aggregateRow
+		err = rows.Scan(&a.day, &a.channel, &a.version, &a.payload, &a.evType, &a.evResult, &a.count)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		aggregates = append(aggregates, a)
+	}
+	rows.Close()
+
+	for _, a := range aggregates {
+		result, err := tx.Exec(`UPDATE event_aggregates SET count=count+?
+			WHERE day=? AND channel=? AND version=? AND payload=? AND type=? AND result=?;`,
+			a.count, a.day, a.channel, a.version, a.payload, a.evType, a.evResult)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if affected > 0 {
+			continue
+		}
+
+		_, err = tx.Exec("INSERT INTO event_aggregates (day,channel,version,payload,type,result,count) VALUES (?, ?, ?, ?, ?, ?, ?);",
+			a.day, a.channel, a.version, a.payload, a.evType, a.evResult, a.count)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	result, err := tx.Exec("DELETE FROM events"+where+";", args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return deleted, tx.Commit()
+}
+
+// daily aggregates, newest first; an empty channel matches all channels
+func (u *sqliteDB) GetEventAggregates(channel string) ([]EventAggregate, error) {
+	result, err := u.query(`SELECT day,channel,version,payload,type,result,count FROM event_aggregates
+		WHERE ?='' OR channel=? ORDER BY day DESC, channel, version, type, result;`, channel, channel)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	out := []EventAggregate{}
+
+	for result.Next() {
+		var a EventAggregate
+		var day int64
+
+		err = result.Scan(&day, &a.Channel, &a.Version, &a.PayloadID, &a.Type, &a.Result, &a.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		a.Day = time.Unix(day, 0).UTC().Format("2006-01-02")
+		out = append(out, a)
+	}
+
+	return out, nil
+}
+
+// A webhook message which could not be delivered
+type WebhookDeadLetter struct {
+	URL       string
+	Body      string
+	Reason    string
 	Timestamp string
 }
 
-func (u *sqliteDB) GetEvents() ([]Event, error) {
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
+func (u *sqliteDB) AddWebhookDeadLetter(url, body, reason string) error {
+	_, err := u.exec("INSERT INTO webhook_dead_letters (url,body,reason,timestamp) VALUES (?, ?, ?, ?);", url, body, reason, time.Now().UTC().Unix())
+	return err
+}
 
-	q, err := u.db.Prepare("SELECT client,type,result,timestamp FROM events ORDER BY timestamp ASC;")
+func (u *sqliteDB) GetWebhookDeadLetters() ([]WebhookDeadLetter, error) {
+	result, err := u.query("SELECT url,body,reason,timestamp FROM webhook_dead_letters ORDER BY timestamp DESC, rowid DESC;")
 	if err != nil {
 		return nil, err
 	}
+	defer result.Close()
+
+	out := []WebhookDeadLetter{}
+
+	for result.Next() {
+		var letter WebhookDeadLetter
+		var timestamp int64
+
+		err = result.Scan(&letter.URL, &letter.Body, &letter.Reason, &timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		letter.Timestamp = time.Unix(timestamp, 0).UTC().String()
+		out = append(out, letter)
+	}
+
+	return out, nil
+}
 
-	result, err := q.Query()
+// remember the payload most recently offered to a machine
+func (u *sqliteDB) SetMachineOffer(machineID, payloadID string) error {
+	_, err := u.exec("INSERT OR REPLACE INTO machine_offers (client, payload, timestamp) VALUES (?, ?, ?);", machineID, payloadID, time.Now().UTC().Unix())
+	return err
+}
+
+// the payload most recently offered to a machine, empty if none
+func (u *sqliteDB) GetMachineOffer(machineID string) (string, error) {
+	row := u.queryRow("SELECT payload FROM machine_offers WHERE client=?;", machineID)
+
+	var payloadID string
+	err := row.Scan(&payloadID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return payloadID, err
+}
+
+// Outcome of updates to a single payload within a channel
+type ReleaseStats struct {
+	Channel   string
+	PayloadID string
+	Version   string
+	Machines  int
+	Downloads int
+	Applied   int
+	// machines which finished the update and machines which reported an
+	// error at any step; each machine is counted once
+	Completed int
+	Failed    int
+}
+
+// share of finished updates which succeeded
+func (r ReleaseStats) SuccessRate() float64 {
+	if r.Completed+r.Failed == 0 {
+		return 0
+	}
+	return float64(r.Completed) / float64(r.Completed+r.Failed)
+}
+
+func (u *sqliteDB) GetReleaseStats() ([]ReleaseStats, error) {
+	result, err := u.query(`SELECT E.channel, E.payload, P.id IS NOT NULL, ifnull(P.ver_build,0), ifnull(P.ver_branch,0), ifnull(P.ver_patch,0), ifnull(P.ver_timestamp,0),
+		count(DISTINCT E.client),
+		sum(CASE WHEN E.type=? AND E.result<>? THEN 1 ELSE 0 END),
+		sum(CASE WHEN E.type=? AND E.result=? THEN 1 ELSE 0 END),
+		count(DISTINCT CASE WHEN (E.type=? AND E.result=?) OR (E.type=? AND E.result<>?) THEN E.client END),
+		count(DISTINCT CASE WHEN E.result=? THEN E.client END)
+		FROM events AS E LEFT OUTER JOIN payloads AS P ON P.id=E.payload
+		WHERE E.payload<>''
+		GROUP BY E.channel, E.payload
+		ORDER BY E.channel, P.ver_build DESC, P.ver_branch DESC, P.ver_patch DESC, P.ver_timestamp DESC;`,
+		eventTypeDownload, eventResultError,
+		eventTypeApply, eventResultOK,
+		eventTypeApply, eventResultDone, eventTypeSuccess, eventResultError,
+		eventResultError)
 	if err != nil {
 		return nil, err
 	}
+	defer result.Close()
 
-	out := []Event{}
+	out := []ReleaseStats{}
 
 	for result.Next() {
-		var ev Event
+		var stats ReleaseStats
+		var ver payloadVersion
+		var timestamp int64
+		var payloadExists int
 
+		err = result.Scan(&stats.Channel, &stats.PayloadID, &payloadExists, &ver.build, &ver.branch, &ver.patch, &timestamp,
+			&stats.Machines, &stats.Downloads, &stats.Applied, &stats.Completed, &stats.Failed)
+		if err != nil {
+			return nil, err
+		}
+
+		// the payload may have been deleted since
+		if payloadExists != 0 {
+			ver.timestamp = time.Unix(timestamp, 0).UTC()
+			stats.Version = ver.String()
+		}
+		out = append(out, stats)
+	}
+
+	return out, nil
+}
+
+// A single Omaha request as recorded by the server, together with the response status
+type ClientRequest struct {
+	MachineID   string
+	Timestamp   string
+	RemoteAddr  string
+	AppID       string
+	Version     string
+	Track       string
+	OSPlatform  string
+	OSVersion   string
+	OSSP        string
+	OSArch      string
+	OEM         string
+	OEMVersion  string
+	BootID      string
+	UpdateCheck bool
+	Ping        bool
+	Events      int
+	Status      string
+
+	// payload offered in response to an update check, if any
+	OfferedID      string
+	OfferedVersion string
+}
+
+// store a request and drop the oldest ones so that at most 'keep' remain
+func (u *sqliteDB) LogRequest(req ClientRequest, keep int) error {
+	var updateCheck, ping int
+	if req.UpdateCheck {
+		updateCheck = 1
+	}
+	if req.Ping {
+		ping = 1
+	}
+
+	tx, err := u.writer.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO requests (client,timestamp,remote_addr,app_id,version,track,os_platform,os_version,os_sp,os_arch,oem,oem_version,boot_id,update_check,ping,events,status,offered_id,offered_version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		req.MachineID, time.Now().UTC().Unix(), req.RemoteAddr, req.AppID, req.Version, req.Track,
+		req.OSPlatform, req.OSVersion, req.OSSP, req.OSArch, req.OEM, req.OEMVersion, req.BootID,
+		updateCheck, ping, req.Events, req.Status, req.OfferedID, req.OfferedVersion)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM requests WHERE rowid <= (SELECT rowid FROM requests ORDER BY rowid DESC LIMIT 1 OFFSET ?);", keep)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// A machine as last seen in its requests
+type Machine struct {
+	MachineID  string
+	LastSeen   string
+	RemoteAddr string
+	Version    string
+	Track      string
+	Status     string
+}
+
+// all machines with requests on record, most recently seen first
+func (u *sqliteDB) ListMachines() ([]Machine, error) {
+	// sqlite takes the bare columns from the row holding the maximum
+	result, err := u.query(`SELECT client,max(rowid),timestamp,remote_addr,version,track,status FROM requests
+		GROUP BY client ORDER BY max(rowid) DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	out := []Machine{}
+
+	for result.Next() {
+		var m Machine
+		var rowid, timestamp int64
+
+		err = result.Scan(&m.MachineID, &rowid, &timestamp, &m.RemoteAddr, &m.Version, &m.Track, &m.Status)
+		if err != nil {
+			return nil, err
+		}
+
+		m.LastSeen = time.Unix(timestamp, 0).UTC().String()
+		out = append(out, m)
+	}
+
+	return out, nil
+}
+
+// newest requests first; an empty machineID matches all machines
+func (u *sqliteDB) GetRequests(machineID string, limit int) ([]ClientRequest, error) {
+	result, err := u.query(`SELECT client,timestamp,remote_addr,app_id,version,track,os_platform,os_version,os_sp,os_arch,oem,oem_version,boot_id,update_check,ping,events,status,offered_id,offered_version
+		FROM requests WHERE ?='' OR client=? ORDER BY timestamp DESC, rowid DESC LIMIT ?;`, machineID, machineID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	out := []ClientRequest{}
+
+	for result.Next() {
+		var req ClientRequest
 		var timestamp int64
+		var updateCheck, ping int
 
-		err = result.Scan(&ev.MachineID, &ev.Type, &ev.Result, &timestamp)
+		err = result.Scan(&req.MachineID, &timestamp, &req.RemoteAddr, &req.AppID, &req.Version, &req.Track,
+			&req.OSPlatform, &req.OSVersion, &req.OSSP, &req.OSArch, &req.OEM, &req.OEMVersion, &req.BootID,
+			&updateCheck, &ping, &req.Events, &req.Status, &req.OfferedID, &req.OfferedVersion)
 		if err != nil {
 			return nil, err
 		}
 
-		ev.Timestamp = time.Unix(timestamp, 0).UTC().String()
-		out = append(out, ev)
+		req.Timestamp = time.Unix(timestamp, 0).UTC().String()
+		req.UpdateCheck = updateCheck != 0
+		req.Ping = ping != 0
+		out = append(out, req)
 	}
 
 	return out, nil
 }
 
 func (u *sqliteDB) SetChannelForceDowngrade(channel string, value bool) error {
+	defer u.cache.invalidate()
+
 	var intValue int
 
 	if value {
@@ -292,31 +1232,36 @@ func (u *sqliteDB) SetChannelForceDowngrade(channel string, value bool) error {
 		intValue = 0
 	}
 
-	u.mutex.Lock()
-	defer u.mutex.Unlock()
+	tx, err := u.writer.Begin()
+	if err != nil {
+		return err
+	}
 
-	result, err := u.db.Exec("UPDATE channel_settings SET force_downgrade=? WHERE channel=?", intValue, channel)
+	result, err := tx.Exec("UPDATE channel_settings SET force_downgrade=? WHERE channel=?", intValue, channel)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
 	affected, err := result.RowsAffected()
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
 	if affected == 0 {
-		_, err = u.db.Exec("INSERT OR IGNORE INTO channel_settings (channel, force_downgrade) VALUES (?, ?);", channel, intValue)
+		_, err = tx.Exec("INSERT OR IGNORE INTO channel_settings (channel, force_downgrade) VALUES (?, ?);", channel, intValue)
 		if err != nil {
+			tx.Rollback()
 			return err
 		}
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func (u *sqliteDB) GetChannelForceDowngrade(channel string) (bool, error) {
-	row := u.db.QueryRow("SELECT force_downgrade FROM channel_settings WHERE channel=?;", channel)
+	row := u.queryRow("SELECT force_downgrade FROM channel_settings WHERE channel=?;", channel)
 
 	var intValue int
 	err := row.Scan(&intValue)
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 )
@@ -219,7 +225,7 @@ func TestDBLGetNewerPayload1(t *testing.T) {
 		return
 	}
 
-	testPl := (payload{SHA1: "abc", SHA256: "uvw", Size: 7423, ID: "xyz"})
+	testPl := (payload{SHA1: "abc", SHA256: "uvw", Size: 7423, ID: "xyz", Version: "800.1.2"})
 	if pl == nil {
 		t.Errorf("Expected payload %+v, got nil", testPl)
 		return
@@ -289,6 +295,30 @@ func TestDBLGetNewerPayload3(t *testing.T) {
 	}
 }
 
+// from a channel without payloads
+func TestDBLGetNewerPayloadEmptyChannel(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	db.AddPayload("foo", "bar", "foobar", 1234, payloadVersion{build: 766, branch: 4, patch: 1, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("foo", "channel1")
+
+	ver, err := parseVersionString("766.4.0")
+	if err != nil {
+		t.Errorf("parseVersionString: %v", err.Error())
+	}
+
+	p, err := db.GetNewerPayload(ver, "channel2")
+	if err != nil {
+		t.Errorf("GetNewerPayload: %v", err.Error())
+	}
+	if p != nil {
+		t.Errorf("GetNewerPayload should have returned nil, instead got %+v", p)
+	}
+}
+
 // have newer version, force downgrade
 func TestDBLGetNewerPayload4(t *testing.T) {
 	db, err := newSqliteDB(":memory:")
@@ -312,7 +342,7 @@ func TestDBLGetNewerPayload4(t *testing.T) {
 		t.Errorf("GetNewerPayload: %v", err.Error())
 	}
 
-	testPl := payload{SHA1: "abc", SHA256: "uvw", Size: 7423, ID: "xyz"}
+	testPl := payload{SHA1: "abc", SHA256: "uvw", Size: 7423, ID: "xyz", Version: "800.1.2"}
 	if pl == nil {
 		t.Errorf("Expected payload %+v, got nil", testPl)
 		return
@@ -349,6 +379,318 @@ func TestDBLGetNewerPayload5(t *testing.T) {
 	}
 }
 
+// required stop in between the client and the latest version
+func TestDBLGetNewerPayloadRequiredStop(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	db.AddPayload("foo", "bar", "foobar", 1234, payloadVersion{build: 600, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("foo", "channel1")
+	db.AddPayload("xyz", "abc", "uvw", 7423, payloadVersion{build: 700, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("xyz", "channel1")
+	db.AddPayload("4r12f", "da23d", "d21c", 6143, payloadVersion{build: 900, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("4r12f", "channel1")
+
+	err = db.SetPayloadRequiredStop("xyz", true)
+	if err != nil {
+		t.Errorf("SetPayloadRequiredStop: %v", err.Error())
+	}
+
+	testData := []struct {
+		current    string
+		expectedID string
+	}{
+		{"500.0.0", "xyz"},
+		{"650.0.0", "xyz"},
+		{"700.0.0", "4r12f"},
+		{"800.0.0", "4r12f"},
+		{"900.0.0", ""},
+	}
+
+	for _, datum := range testData {
+		ver, err := parseVersionString(datum.current)
+		if err != nil {
+			t.Errorf("parseVersionString: %v", err.Error())
+			continue
+		}
+		pl, err := db.GetNewerPayload(ver, "channel1")
+		if err != nil {
+			t.Errorf("GetNewerPayload: %v", err.Error())
+			continue
+		}
+
+		var id string
+		if pl != nil {
+			id = pl.ID
+		}
+		if id != datum.expectedID {
+			t.Errorf("From '%v': expected payload '%v', got '%v'", datum.current, datum.expectedID, id)
+		}
+	}
+}
+
+// a yanked required stop is not offered, but still cannot be skipped
+func TestDBLGetNewerPayloadYankedRequiredStop(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	db.AddPayload("foo", "bar", "foobar", 1234, payloadVersion{build: 600, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("foo", "channel1")
+	db.AddPayload("xyz", "abc", "uvw", 7423, payloadVersion{build: 700, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("xyz", "channel1")
+	db.AddPayload("4r12f", "da23d", "d21c", 6143, payloadVersion{build: 900, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("4r12f", "channel1")
+
+	err = db.SetPayloadRequiredStop("xyz", true)
+	if err != nil {
+		t.Errorf("SetPayloadRequiredStop: %v", err.Error())
+	}
+	err = db.YankPayload("xyz", "channel1", "breaks networking", false)
+	if err != nil {
+		t.Errorf("YankPayload: %v", err.Error())
+	}
+
+	testData := []struct {
+		current    string
+		expectedID string
+	}{
+		{"500.0.0", "foo"},
+		{"600.0.0", ""},
+		{"650.0.0", ""},
+		{"700.0.0", "4r12f"},
+		{"900.0.0", ""},
+	}
+
+	for _, datum := range testData {
+		ver, _ := parseVersionString(datum.current)
+		pl, err := db.GetNewerPayload(ver, "channel1")
+		if err != nil {
+			t.Errorf("GetNewerPayload: %v", err.Error())
+			continue
+		}
+
+		var id string
+		if pl != nil {
+			id = pl.ID
+		}
+		if id != datum.expectedID {
+			t.Errorf("From '%v': expected payload '%v', got '%v'", datum.current, datum.expectedID, id)
+		}
+	}
+}
+
+// the latest version cannot be installed from old versions
+func TestDBLGetNewerPayloadMinSource(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	db.AddPayload("foo", "bar", "foobar", 1234, payloadVersion{build: 700, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("foo", "channel1")
+	db.AddPayload("xyz", "abc", "uvw", 7423, payloadVersion{build: 900, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("xyz", "channel1")
+
+	minSource, _ := parseVersionString("650.0.0")
+	err = db.SetPayloadMinSourceVersion("xyz", &minSource)
+	if err != nil {
+		t.Errorf("SetPayloadMinSourceVersion: %v", err.Error())
+	}
+
+	ver, _ := parseVersionString("500.0.0")
+	pl, err := db.GetNewerPayload(ver, "channel1")
+	if err != nil {
+		t.Errorf("GetNewerPayload: %v", err.Error())
+	}
+	if pl == nil || pl.ID != "foo" {
+		t.Errorf("Expected payload 'foo', got %+v", pl)
+	}
+
+	ver, _ = parseVersionString("650.0.0")
+	pl, err = db.GetNewerPayload(ver, "channel1")
+	if err != nil {
+		t.Errorf("GetNewerPayload: %v", err.Error())
+	}
+	if pl == nil || pl.ID != "xyz" {
+		t.Errorf("Expected payload 'xyz', got %+v", pl)
+	}
+
+	err = db.SetPayloadMinSourceVersion("nonexistent", &minSource)
+	if err == nil {
+		t.Error("SetPayloadMinSourceVersion should fail for a nonexistent payload")
+	}
+}
+
+// yanked payloads are not offered, machines running them move on
+func TestDBLGetNewerPayloadYanked(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	db.AddPayload("foo", "bar", "foobar", 1234, payloadVersion{build: 700, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("foo", "channel1")
+	db.AddPayload("xyz", "abc", "uvw", 7423, payloadVersion{build: 800, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("xyz", "channel1")
+	db.AttachPayloadToChannel("xyz", "channel2")
+
+	err = db.YankPayload("xyz", "channel1", "breaks networking", false)
+	if err != nil {
+		t.Errorf("YankPayload: %v", err.Error())
+	}
+
+	imgs, err := db.ListImages("channel1")
+	if err != nil {
+		t.Errorf("ListImages: %v", err.Error())
+	}
+	if n := len(imgs); n != 2 {
+		t.Fatalf("Expected 2 images, got %v", n)
+	}
+	if !imgs[1].Yanked || imgs[1].YankReason != "breaks networking" {
+		t.Errorf("Expected image 'xyz' to be yanked, got %+v", imgs[1])
+	}
+
+	ver, _ := parseVersionString("600.0.0")
+	pl, err := db.GetNewerPayload(ver, "channel1")
+	if err != nil {
+		t.Errorf("GetNewerPayload: %v", err.Error())
+	}
+	if pl == nil || pl.ID != "foo" {
+		t.Errorf("Expected payload 'foo', got %+v", pl)
+	}
+
+	// other channels are not affected
+	pl, err = db.GetNewerPayload(ver, "channel2")
+	if err != nil {
+		t.Errorf("GetNewerPayload: %v", err.Error())
+	}
+	if pl == nil || pl.ID != "xyz" {
+		t.Errorf("Expected payload 'xyz', got %+v", pl)
+	}
+
+	// without the downgrade option machines stay where they are
+	ver, _ = parseVersionString("800.0.0")
+	pl, err = db.GetNewerPayload(ver, "channel1")
+	if err != nil {
+		t.Errorf("GetNewerPayload: %v", err.Error())
+	}
+	if pl != nil {
+		t.Errorf("GetNewerPayload should have returned nil, instead got %+v", pl)
+	}
+
+	err = db.YankPayload("xyz", "channel1", "breaks networking", true)
+	if err != nil {
+		t.Errorf("YankPayload: %v", err.Error())
+	}
+	pl, err = db.GetNewerPayload(ver, "channel1")
+	if err != nil {
+		t.Errorf("GetNewerPayload: %v", err.Error())
+	}
+	if pl == nil || pl.ID != "foo" {
+		t.Errorf("Expected payload 'foo', got %+v", pl)
+	}
+
+	// only machines running the yanked version get downgraded
+	ver, _ = parseVersionString("801.0.0")
+	pl, err = db.GetNewerPayload(ver, "channel1")
+	if err != nil {
+		t.Errorf("GetNewerPayload: %v", err.Error())
+	}
+	if pl != nil {
+		t.Errorf("GetNewerPayload should have returned nil, instead got %+v", pl)
+	}
+
+	err = db.UnyankPayload("xyz", "channel1")
+	if err != nil {
+		t.Errorf("UnyankPayload: %v", err.Error())
+	}
+	ver, _ = parseVersionString("700.0.0")
+	pl, err = db.GetNewerPayload(ver, "channel1")
+	if err != nil {
+		t.Errorf("GetNewerPayload: %v", err.Error())
+	}
+	if pl == nil || pl.ID != "xyz" {
+		t.Errorf("Expected payload 'xyz', got %+v", pl)
+	}
+}
+
+func TestDBDeltas(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	db.AddPayload("xyz", "abc", "uvw", 7423, payloadVersion{build: 800, branch: 0, patch: 0, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("xyz", "channel1")
+
+	source, _ := parseVersionString("766.4.1")
+	err = db.AddDelta("d1", "d1sha1", "d1sha256", 123, source, "xyz")
+	if err != nil {
+		t.Errorf("AddDelta: %v", err.Error())
+	}
+
+	d, err := db.GetDelta(source, "xyz")
+	if err != nil {
+		t.Errorf("GetDelta: %v", err.Error())
+	}
+	testDelta := delta{ID: "d1", SourceVersion: "766.4.1", Target: "xyz", SHA1: "d1sha1", SHA256: "d1sha256", Size: 123}
+	if d == nil || *d != testDelta {
+		t.Errorf("Expected delta %+v, got %+v", testDelta, d)
+	}
+
+	for id, expected := range map[string]bool{"xyz": true, "d1": true, "nope": false} {
+		exists, err := db.FileExists(id)
+		if err != nil {
+			t.Errorf("FileExists: %v", err.Error())
+		}
+		if exists != expected {
+			t.Errorf("FileExists(%v) should be %v", id, expected)
+		}
+	}
+
+	other, _ := parseVersionString("766.4.2")
+	d, err = db.GetDelta(other, "xyz")
+	if err != nil {
+		t.Errorf("GetDelta: %v", err.Error())
+	}
+	if d != nil {
+		t.Errorf("GetDelta should have returned nil, instead got %+v", d)
+	}
+
+	deltas, err := db.ListDeltas("xyz")
+	if err != nil {
+		t.Errorf("ListDeltas: %v", err.Error())
+	}
+	if len(deltas) != 1 || deltas[0] != testDelta {
+		t.Errorf("Expected deltas %+v, got %+v", []delta{testDelta}, deltas)
+	}
+
+	err = db.DeleteDelta("d1")
+	if err != nil {
+		t.Errorf("DeleteDelta: %v", err.Error())
+	}
+	deltas, err = db.ListDeltas("xyz")
+	if err != nil {
+		t.Errorf("ListDeltas: %v", err.Error())
+	}
+	if len(deltas) != 0 {
+		t.Errorf("Expected no deltas, got %+v", deltas)
+	}
+
+	err = db.DeleteDelta("d1")
+	if err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing delta, got %v", err)
+	}
+	err = db.DeleteDelta("xyz")
+	if err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a payload, got %v", err)
+	}
+}
+
 func TestDBDeleting1(t *testing.T) {
 	db, err := newSqliteDB(":memory:")
 	if err != nil {
@@ -485,3 +827,527 @@ func TestDBSetChannelForceDowngrade(t *testing.T) {
 		t.Error("force_downgrade value is true, should have been false")
 	}
 }
+
+func TestDBRequests(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	for i := 0; i < 5; i++ {
+		err = db.LogRequest(ClientRequest{MachineID: "foo", Version: fmt.Sprintf("766.4.%v", i), UpdateCheck: true, Status: "noupdate"}, 4)
+		if err != nil {
+			t.Errorf("LogRequest: %v", err.Error())
+		}
+	}
+	err = db.LogRequest(ClientRequest{MachineID: "bar", Ping: true, Status: "ok"}, 4)
+	if err != nil {
+		t.Errorf("LogRequest: %v", err.Error())
+	}
+
+	reqs, err := db.GetRequests("foo", 100)
+	if err != nil {
+		t.Errorf("GetRequests: %v", err.Error())
+	}
+	// the oldest two were rotated out
+	if n := len(reqs); n != 3 {
+		t.Fatalf("Expected 3 requests, got %v", n)
+	}
+	if reqs[0].Version != "766.4.4" || !reqs[0].UpdateCheck || reqs[0].Ping {
+		t.Errorf("Unexpected newest request %+v", reqs[0])
+	}
+
+	machines, err := db.ListMachines()
+	if err != nil {
+		t.Errorf("ListMachines: %v", err.Error())
+	}
+	if len(machines) != 2 || machines[1].MachineID != "foo" || machines[1].Version != "766.4.4" {
+		t.Errorf("Unexpected machines %+v", machines)
+	}
+
+	reqs, err = db.GetRequests("", 2)
+	if err != nil {
+		t.Errorf("GetRequests: %v", err.Error())
+	}
+	if n := len(reqs); n != 2 {
+		t.Fatalf("Expected 2 requests, got %v", n)
+	}
+	if reqs[0].MachineID != "bar" || !reqs[0].Ping {
+		t.Errorf("Unexpected newest request %+v", reqs[0])
+	}
+
+	// rotation keeps 'keep' requests even if some in between are gone
+	_, err = db.exec("DELETE FROM requests WHERE version='766.4.3';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.LogRequest(ClientRequest{MachineID: "bar", Ping: true, Status: "ok"}, 4)
+	if err != nil {
+		t.Errorf("LogRequest: %v", err.Error())
+	}
+	reqs, err = db.GetRequests("", 100)
+	if err != nil {
+		t.Errorf("GetRequests: %v", err.Error())
+	}
+	if n := len(reqs); n != 4 {
+		t.Errorf("Expected 4 requests, got %v", n)
+	}
+}
+
+func TestDBEventFilter(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	db.LogEvent(Event{MachineID: "foo", Type: eventTypeDownload, Result: eventResultOK, Channel: "stable", Version: "766.4.1"})
+	db.LogEvent(Event{MachineID: "foo", Type: eventTypeApply, Result: eventResultError, Channel: "stable", Version: "766.4.1"})
+	db.LogEvent(Event{MachineID: "bar", Type: eventTypeDownload, Result: eventResultOK, Channel: "beta", Version: "800.1.2"})
+
+	events, err := db.GetEvents(EventFilter{})
+	if err != nil {
+		t.Errorf("GetEvents: %v", err.Error())
+	}
+	if n := len(events); n != 3 {
+		t.Errorf("Expected 3 events, got %v", n)
+	}
+
+	download := eventTypeDownload
+	events, err = db.GetEvents(EventFilter{Type: &download, Channel: "stable"})
+	if err != nil {
+		t.Errorf("GetEvents: %v", err.Error())
+	}
+	testEv := Event{MachineID: "foo", Type: eventTypeDownload, Result: eventResultOK, Channel: "stable", Version: "766.4.1"}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %+v", events)
+	}
+	events[0].Timestamp = ""
+	if events[0] != testEv {
+		t.Errorf("Expected event %+v, got %+v", testEv, events[0])
+	}
+
+	// newest first
+	events, err = db.GetEvents(EventFilter{MachineID: "foo", Page: 1, PerPage: 1})
+	if err != nil {
+		t.Errorf("GetEvents: %v", err.Error())
+	}
+	if len(events) != 1 || events[0].Type != eventTypeApply {
+		t.Errorf("Expected the 'apply' event, got %+v", events)
+	}
+	events, err = db.GetEvents(EventFilter{MachineID: "foo", Page: 2, PerPage: 1})
+	if err != nil {
+		t.Errorf("GetEvents: %v", err.Error())
+	}
+	if len(events) != 1 || events[0].Type != eventTypeDownload {
+		t.Errorf("Expected the 'download' event, got %+v", events)
+	}
+
+	count, err := db.CountEvents(EventFilter{MachineID: "foo", Page: 2, PerPage: 1})
+	if err != nil {
+		t.Errorf("CountEvents: %v", err.Error())
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 events, got %v", count)
+	}
+
+	count, err = db.CountEvents(EventFilter{Until: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Errorf("CountEvents: %v", err.Error())
+	}
+	if count != 0 {
+		t.Errorf("Expected no events, got %v", count)
+	}
+}
+
+func TestDBReleaseStats(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	db.AddPayload("xyz", "abc", "uvw", 7423, payloadVersion{build: 800, branch: 1, patch: 2, timestamp: time.Unix(0, 0).UTC()})
+	db.AttachPayloadToChannel("xyz", "stable")
+
+	offer, err := db.GetMachineOffer("foo")
+	if err != nil {
+		t.Errorf("GetMachineOffer: %v", err.Error())
+	}
+	if offer != "" {
+		t.Errorf("Expected no offer, got '%v'", offer)
+	}
+
+	err = db.SetMachineOffer("foo", "xyz")
+	if err != nil {
+		t.Errorf("SetMachineOffer: %v", err.Error())
+	}
+	offer, err = db.GetMachineOffer("foo")
+	if err != nil {
+		t.Errorf("GetMachineOffer: %v", err.Error())
+	}
+	if offer != "xyz" {
+		t.Errorf("Expected offer 'xyz', got '%v'", offer)
+	}
+
+	db.LogEvent(Event{MachineID: "foo", Type: eventTypeDownload, Result: eventResultOK, Channel: "stable", Version: "766.4.1", PayloadID: "xyz"})
+	db.LogEvent(Event{MachineID: "foo", Type: eventTypeApply, Result: eventResultOK, Channel: "stable", Version: "766.4.1", PayloadID: "xyz"})
+	db.LogEvent(Event{MachineID: "foo", Type: eventTypeApply, Result: eventResultDone, Channel: "stable", Version: "800.1.2", PreviousVersion: "766.4.1", PayloadID: "xyz"})
+	db.LogEvent(Event{MachineID: "bar", Type: eventTypeDownload, Result: eventResultOK, Channel: "stable", Version: "766.4.1", PayloadID: "xyz"})
+	db.LogEvent(Event{MachineID: "bar", Type: eventTypeApply, Result: eventResultError, Channel: "stable", Version: "766.4.1", PayloadID: "xyz", ErrorCode: 7})
+	// a machine failing at several steps counts as one failure
+	db.LogEvent(Event{MachineID: "bar", Type: eventTypeSuccess, Result: eventResultError, Channel: "stable", Version: "766.4.1", PayloadID: "xyz", ErrorCode: 7})
+	db.LogEvent(Event{MachineID: "baz", Type: eventTypeDownload, Result: eventResultOK, Channel: "stable", Version: "766.4.1"})
+
+	stats, err := db.GetReleaseStats()
+	if err != nil {
+		t.Errorf("GetReleaseStats: %v", err.Error())
+	}
+	testStats := ReleaseStats{Channel: "stable", PayloadID: "xyz", Version: "800.1.2", Machines: 2, Downloads: 2, Applied: 1, Completed: 1, Failed: 1}
+	if len(stats) != 1 || stats[0] != testStats {
+		t.Errorf("Expected stats %+v, got %+v", []ReleaseStats{testStats}, stats)
+	}
+	if rate := stats[0].SuccessRate(); rate != 0.5 {
+		t.Errorf("Expected success rate 0.5, got %v", rate)
+	}
+
+	events, err := db.GetEvents(EventFilter{PayloadID: "xyz", MachineID: "bar"})
+	if err != nil {
+		t.Errorf("GetEvents: %v", err.Error())
+	}
+	if len(events) != 3 || events[0].ErrorCode != 7 {
+		t.Errorf("Expected 3 events of 'bar', the latest with error code 7, got %+v", events)
+	}
+}
+
+func TestDBCompactEvents(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Errorf("newSqliteDB: %v", err.Error())
+	}
+
+	for i := 0; i < 5; i++ {
+		db.LogEvent(Event{MachineID: fmt.Sprintf("m%v", i), Type: eventTypeDownload, Result: eventResultOK, Channel: "stable", Version: "766.4.1", PayloadID: "xyz"})
+	}
+	db.LogEvent(Event{MachineID: "m0", Type: eventTypeApply, Result: eventResultError, Channel: "stable", Version: "766.4.1", PayloadID: "xyz"})
+
+	// nothing is old enough
+	deleted, err := db.CompactEvents(time.Hour, 0)
+	if err != nil {
+		t.Errorf("CompactEvents: %v", err.Error())
+	}
+	if deleted != 0 {
+		t.Errorf("Expected no events to be compacted, got %v", deleted)
+	}
+
+	deleted, err = db.CompactEvents(0, 2)
+	if err != nil {
+		t.Errorf("CompactEvents: %v", err.Error())
+	}
+	if deleted != 4 {
+		t.Errorf("Expected 4 events to be compacted, got %v", deleted)
+	}
+
+	count, err := db.CountEvents(EventFilter{})
+	if err != nil {
+		t.Errorf("CountEvents: %v", err.Error())
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 events to remain, got %v", count)
+	}
+
+	// compacting again adds up to the same aggregate
+	deleted, err = db.CompactEvents(0, 1)
+	if err != nil {
+		t.Errorf("CompactEvents: %v", err.Error())
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 event to be compacted, got %v", deleted)
+	}
+
+	aggregates, err := db.GetEventAggregates("stable")
+	if err != nil {
+		t.Errorf("GetEventAggregates: %v", err.Error())
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	testAggregate := EventAggregate{Day: today, Channel: "stable", Version: "766.4.1", PayloadID: "xyz", Type: eventTypeDownload, Result: eventResultOK, Count: 5}
+	if len(aggregates) != 1 || aggregates[0] != testAggregate {
+		t.Errorf("Expected aggregates %+v, got %+v", []EventAggregate{testAggregate}, aggregates)
+	}
+
+	aggregates, err = db.GetEventAggregates("beta")
+	if err != nil {
+		t.Errorf("GetEventAggregates: %v", err.Error())
+	}
+	if len(aggregates) != 0 {
+		t.Errorf("Expected no aggregates, got %+v", aggregates)
+	}
+
+	// the newest events are kept even if some in between were deleted
+	for i := 0; i < 3; i++ {
+		db.LogEvent(Event{MachineID: fmt.Sprintf("n%v", i), Type: eventTypeDownload, Result: eventResultOK, Channel: "beta", Version: "766.4.1"})
+	}
+	_, err = db.exec("DELETE FROM events WHERE client='n1';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = db.CompactEvents(0, 2)
+	if err != nil {
+		t.Errorf("CompactEvents: %v", err.Error())
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 event to be compacted, got %v", deleted)
+	}
+}
+
+// a database in a temporary file, which unlike ':memory:' reads on separate connections
+func newTempSqliteDB(tb testing.TB) (*sqliteDB, func()) {
+	dir, err := ioutil.TempDir("", "comaha-db")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	db, err := newSqliteDB(path.Join(dir, "test.sqlite"))
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatalf("newSqliteDB: %v", err.Error())
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// a channel with 'n' payloads and a delta to the latest one from each older one
+func fillChannel(tb testing.TB, db *sqliteDB, channel string, n int) {
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("%v-%v", channel, i)
+		err := db.AddPayload(id, "sha1", "sha256", 1000, payloadVersion{build: int32(i), timestamp: time.Unix(0, 0).UTC()})
+		if err != nil {
+			tb.Fatalf("AddPayload: %v", err.Error())
+		}
+		err = db.AttachPayloadToChannel(id, channel)
+		if err != nil {
+			tb.Fatalf("AttachPayloadToChannel: %v", err.Error())
+		}
+	}
+	for i := 1; i < n; i++ {
+		err := db.AddDelta(fmt.Sprintf("%v-delta-%v", channel, i), "sha1", "sha256", 100, payloadVersion{build: int32(i), timestamp: time.Unix(0, 0).UTC()}, fmt.Sprintf("%v-%v", channel, n))
+		if err != nil {
+			tb.Fatalf("AddDelta: %v", err.Error())
+		}
+	}
+}
+
+func TestDBReadsDuringWrite(t *testing.T) {
+	db, cleanup := newTempSqliteDB(t)
+	defer cleanup()
+
+	var mode string
+	err := db.writer.QueryRow("PRAGMA journal_mode;").Scan(&mode)
+	if err != nil || mode != "wal" {
+		t.Errorf("Expected WAL mode, got '%v' (%v)", mode, err)
+	}
+
+	fillChannel(t, db, "stable", 2)
+
+	// hold the writing connection with an uncommitted change
+	tx, err := db.writer.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM channel_payload_rel;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *payload, 1)
+	go func() {
+		p, err := db.GetNewerPayload(payloadVersion{build: 1, timestamp: time.Unix(0, 0).UTC()}, "stable")
+		if err != nil {
+			t.Errorf("GetNewerPayload: %v", err.Error())
+		}
+		done <- p
+	}()
+
+	select {
+	case p := <-done:
+		if p == nil || p.ID != "stable-2" {
+			t.Errorf("Expected the committed payload 'stable-2', got %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read blocked by an open write transaction")
+	}
+}
+
+func TestDBConcurrentAccess(t *testing.T) {
+	db, cleanup := newTempSqliteDB(t)
+	defer cleanup()
+
+	fillChannel(t, db, "stable", 5)
+	v1 := payloadVersion{build: 1, timestamp: time.Unix(0, 0).UTC()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if i%2 == 0 {
+					_, err := db.GetNewerPayload(v1, "stable")
+					if err == nil {
+						_, err = db.GetDelta(v1, "stable-5")
+					}
+					if err != nil {
+						t.Errorf("Reading: %v", err.Error())
+						return
+					}
+				} else {
+					err := db.LogRequest(ClientRequest{MachineID: fmt.Sprintf("m%v", i), Status: "ok"}, 100)
+					if err == nil {
+						err = db.LogEvent(Event{MachineID: fmt.Sprintf("m%v", i), Type: eventTypeDownload, Result: eventResultOK})
+					}
+					if err != nil {
+						t.Errorf("Writing: %v", err.Error())
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	count, err := db.CountEvents(EventFilter{})
+	if err != nil || count != 4*50 {
+		t.Errorf("Expected %v events, got %v (%v)", 4*50, count, err)
+	}
+}
+
+// The reads of an update check. Compare the throughput for parallel clients
+// with e.g. 'go test -run - -bench DBUpdateCheck -cpu 1,2,4,8'.
+func BenchmarkDBUpdateCheck(b *testing.B) {
+	db, cleanup := newTempSqliteDB(b)
+	defer cleanup()
+
+	fillChannel(b, db, "stable", 50)
+	source := payloadVersion{build: 10, timestamp: time.Unix(0, 0).UTC()}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p, err := db.GetNewerPayload(source, "stable")
+			if err != nil || p == nil {
+				b.Errorf("GetNewerPayload: %+v, %v", p, err)
+				return
+			}
+			_, err = db.GetDelta(source, p.ID)
+			if err != nil {
+				b.Errorf("GetDelta: %v", err.Error())
+				return
+			}
+		}
+	})
+}
+
+// update checks together with recording the requests, as the update handler does
+func BenchmarkDBUpdateCheckWithLog(b *testing.B) {
+	db, cleanup := newTempSqliteDB(b)
+	defer cleanup()
+
+	fillChannel(b, db, "stable", 50)
+	source := payloadVersion{build: 10, timestamp: time.Unix(0, 0).UTC()}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p, err := db.GetNewerPayload(source, "stable")
+			if err != nil || p == nil {
+				b.Errorf("GetNewerPayload: %+v, %v", p, err)
+				return
+			}
+			err = db.LogRequest(ClientRequest{MachineID: "machine", Status: "ok", OfferedID: p.ID}, 1000)
+			if err != nil {
+				b.Errorf("LogRequest: %v", err.Error())
+				return
+			}
+		}
+	})
+}
+
+func TestDBChannelCache(t *testing.T) {
+	db, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+
+	fillChannel(t, db, "stable", 2)
+	v1 := payloadVersion{build: 1, timestamp: time.Unix(0, 0).UTC()}
+
+	expectOffer := func(what, id string, isDelta bool) {
+		p, err := db.GetNewerPayload(v1, "stable")
+		if err != nil {
+			t.Fatalf("GetNewerPayload: %v", err.Error())
+		}
+		if id == "" {
+			if p != nil {
+				t.Errorf("%v: expected no payload, got %+v", what, p)
+			}
+			return
+		}
+		if p == nil || p.ID != id {
+			t.Errorf("%v: expected payload '%v', got %+v", what, id, p)
+			return
+		}
+		d, err := db.GetDelta(v1, p.ID)
+		if err != nil {
+			t.Fatalf("GetDelta: %v", err.Error())
+		}
+		if (d != nil) != isDelta {
+			t.Errorf("%v: expected delta %v, got %+v", what, isDelta, d)
+		}
+	}
+
+	expectOffer("initially", "stable-2", true)
+
+	// served from the cache, changes made behind its back are not seen
+	_, err = db.writer.Exec("DELETE FROM channel_payload_rel; DELETE FROM deltas;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOffer("cached", "stable-2", true)
+
+	// changes through the database interface invalidate it
+	err = db.AttachPayloadToChannel("stable-2", "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOffer("after attaching", "stable-2", false)
+
+	err = db.AddDelta("delta", "sha1", "sha256", 10, v1, "stable-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOffer("after adding a delta", "stable-2", true)
+
+	err = db.YankPayload("stable-2", "stable", "broken", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOffer("after yanking", "", false)
+
+	err = db.UnyankPayload("stable-2", "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeletePayload("stable-2", "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOffer("after deleting", "", false)
+
+	// unknown channels are not kept
+	db.GetNewerPayload(v1, "no-such-channel")
+	if _, ok := db.cache.heads["no-such-channel"]; ok {
+		t.Error("Empty channel was cached")
+	}
+}
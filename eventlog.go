@@ -0,0 +1,177 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Writes the events reported by machines to the database in the background,
+// in batches of up to 'batchSize' at least every 'interval'. When the queue is
+// full, events are written on the caller's goroutine instead, which slows
+// clients down rather than losing their events.
+type eventWriter struct {
+	// first, to be aligned for atomic access on 32 bit platforms
+	stats eventWriterStats
+
+	db        userDB
+	batchSize int
+	interval  time.Duration
+
+	// guards against queueing after Close
+	mutex  sync.RWMutex
+	closed bool
+	queue  chan Event
+	done   chan struct{}
+}
+
+// counters of an eventWriter, updated atomically
+type eventWriterStats struct {
+	// taken from the queue for the next batch
+	Pending   uint64 `json:"pending"`
+	Written   uint64 `json:"written"`
+	Batches   uint64 `json:"batches"`
+	Overflows uint64 `json:"overflows"`
+	Failed    uint64 `json:"failed"`
+}
+
+// state of the event queue as reported by the admin API
+type eventQueueStatus struct {
+	Queued   int `json:"queued"`
+	Capacity int `json:"capacity"`
+	eventWriterStats
+}
+
+// nil if events are written synchronously
+var eventLog *eventWriter
+
+func newEventWriter(db userDB, queueSize, batchSize int, interval time.Duration) *eventWriter {
+	w := &eventWriter{
+		db:        db,
+		batchSize: batchSize,
+		interval:  interval,
+		queue:     make(chan Event, queueSize),
+		done:      make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+// store an event reported by a machine
+func logEvent(ev Event) {
+	ev.received = time.Now().UTC()
+
+	if eventLog == nil {
+		err := db.LogEvent(ev)
+		if err != nil {
+			log.Errorf("Failed to store event: %v", err.Error())
+		}
+		return
+	}
+
+	eventLog.add(ev)
+}
+
+func (w *eventWriter) add(ev Event) {
+	w.mutex.RLock()
+	if !w.closed {
+		select {
+		case w.queue <- ev:
+			w.mutex.RUnlock()
+			return
+		default:
+		}
+	}
+	w.mutex.RUnlock()
+
+	atomic.AddUint64(&w.stats.Overflows, 1)
+	w.write([]Event{ev})
+}
+
+// stop accepting events and wait until the queued ones are written
+func (w *eventWriter) Close() {
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+
+	<-w.done
+}
+
+func (w *eventWriter) status() eventQueueStatus {
+	return eventQueueStatus{
+		Queued:   len(w.queue),
+		Capacity: cap(w.queue),
+		eventWriterStats: eventWriterStats{
+			Pending:   atomic.LoadUint64(&w.stats.Pending),
+			Written:   atomic.LoadUint64(&w.stats.Written),
+			Batches:   atomic.LoadUint64(&w.stats.Batches),
+			Overflows: atomic.LoadUint64(&w.stats.Overflows),
+			Failed:    atomic.LoadUint64(&w.stats.Failed),
+		},
+	}
+}
+
+func (w *eventWriter) run() {
+	defer close(w.done)
+
+	var reportedOverflows uint64
+	batch := make([]Event, 0, w.batchSize)
+
+	for ev := range w.queue {
+		batch = append(batch[:0], ev)
+		atomic.StoreUint64(&w.stats.Pending, 1)
+
+		// collect what arrives until the batch is full or the interval has passed
+		timer := time.NewTimer(w.interval)
+	collect:
+		for len(batch) < w.batchSize {
+			select {
+			case ev, ok := <-w.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, ev)
+				atomic.StoreUint64(&w.stats.Pending, uint64(len(batch)))
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		w.write(batch)
+		atomic.StoreUint64(&w.stats.Pending, 0)
+
+		if overflows := atomic.LoadUint64(&w.stats.Overflows); overflows != reportedOverflows {
+			log.Warnf("Event queue: %v events written synchronously as the queue was full", overflows-reportedOverflows)
+			reportedOverflows = overflows
+		}
+	}
+}
+
+// write a batch; if that fails, write its events one by one so that a
+// single bad event does not lose the others
+func (w *eventWriter) write(batch []Event) {
+	err := w.db.LogEvents(batch)
+	if err == nil {
+		atomic.AddUint64(&w.stats.Written, uint64(len(batch)))
+		atomic.AddUint64(&w.stats.Batches, 1)
+		return
+	}
+
+	if len(batch) > 1 {
+		log.Warnf("Event queue: writing a batch of %v events failed, retrying individually: %v", len(batch), err.Error())
+		for _, ev := range batch {
+			w.write([]Event{ev})
+		}
+		return
+	}
+
+	log.Errorf("Event queue: failed to store event of machine '%v': %v", batch[0].MachineID, err.Error())
+	atomic.AddUint64(&w.stats.Failed, 1)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records written events; can hold the first write and fails for machine "bad"
+type fakeEventDB struct {
+	userDB
+
+	mutex   sync.Mutex
+	written []Event
+	calls   int
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (f *fakeEventDB) LogEvents(evs []Event) error {
+	f.mutex.Lock()
+	f.calls++
+	first := f.calls == 1
+	f.mutex.Unlock()
+
+	if first && f.release != nil {
+		close(f.entered)
+		<-f.release
+	}
+
+	for _, ev := range evs {
+		if ev.MachineID == "bad" {
+			return errors.New("bad event")
+		}
+	}
+
+	f.mutex.Lock()
+	f.written = append(f.written, evs...)
+	f.mutex.Unlock()
+	return nil
+}
+
+func TestEventWriterBatches(t *testing.T) {
+	testDB, err := newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+
+	w := newEventWriter(testDB, 100, 10, time.Hour)
+	reported := time.Now().Add(-time.Hour).UTC()
+	for i := 0; i < 25; i++ {
+		w.add(Event{MachineID: "machine", Type: eventTypeDownload, Result: eventResultOK, received: reported})
+	}
+	w.Close()
+
+	status := w.status()
+	if status.Written != 25 || status.Batches != 3 || status.Overflows != 0 || status.Failed != 0 || status.Queued != 0 {
+		t.Errorf("Expected 25 events in 3 batches, got %+v", status)
+	}
+
+	events, err := testDB.GetEvents(EventFilter{})
+	if err != nil {
+		t.Fatalf("GetEvents: %v", err.Error())
+	}
+	if len(events) != 25 {
+		t.Fatalf("Expected 25 stored events, got %v", len(events))
+	}
+	if expected := time.Unix(reported.Unix(), 0).UTC().String(); events[0].Timestamp != expected {
+		t.Errorf("Expected the time of reporting %v, got %v", expected, events[0].Timestamp)
+	}
+
+	// events added after closing are written directly
+	w.add(Event{MachineID: "late"})
+	if count, _ := testDB.CountEvents(EventFilter{MachineID: "late"}); count != 1 {
+		t.Errorf("Expected the late event to be written, got %v", count)
+	}
+}
+
+func TestEventWriterOverflow(t *testing.T) {
+	f := &fakeEventDB{entered: make(chan struct{}), release: make(chan struct{})}
+	w := newEventWriter(f, 1, 1, time.Hour)
+
+	// the writer is stuck on the first event, the second fills the queue
+	w.add(Event{MachineID: "first"})
+	<-f.entered
+	w.add(Event{MachineID: "second"})
+
+	w.add(Event{MachineID: "third"})
+	if status := w.status(); status.Overflows != 1 || status.Queued != 1 {
+		t.Errorf("Expected one overflow and one queued event, got %+v", status)
+	}
+	f.mutex.Lock()
+	if len(f.written) != 1 || f.written[0].MachineID != "third" {
+		t.Errorf("Expected the overflowing event to be written at once, got %+v", f.written)
+	}
+	f.mutex.Unlock()
+
+	close(f.release)
+	w.Close()
+
+	if status := w.status(); status.Written != 3 {
+		t.Errorf("Expected all 3 events to be written, got %+v", status)
+	}
+}
+
+func TestEventWriterFailures(t *testing.T) {
+	f := &fakeEventDB{}
+	w := newEventWriter(f, 10, 10, time.Hour)
+
+	w.add(Event{MachineID: "a"})
+	w.add(Event{MachineID: "bad"})
+	w.add(Event{MachineID: "b"})
+	w.Close()
+
+	if status := w.status(); status.Written != 2 || status.Failed != 1 {
+		t.Errorf("Expected 2 events written and 1 failed, got %+v", status)
+	}
+	if len(f.written) != 2 {
+		t.Errorf("Expected the good events to be written individually, got %+v", f.written)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	fetchQueueSize = 100
+
+	// finished jobs kept for status queries
+	fetchHistorySize = 100
+)
+
+// states of a fetch job
+const (
+	fetchQueued      = "queued"
+	fetchDownloading = "downloading"
+	fetchStoring     = "storing"
+	fetchDone        = "done"
+	fetchFailed      = "failed"
+)
+
+// A payload to be downloaded from a URL and added like an upload to
+// /admin/add_payload. The exported fields are its status as reported by
+// the admin API.
+type fetchJob struct {
+	ID      int    `json:"id"`
+	URL     string `json:"url"`
+	Version string `json:"version"`
+	Channel string `json:"channel"`
+	State   string `json:"state"`
+	// bytes downloaded so far and the size announced by the server, -1 if unknown
+	Received  int64     `json:"received"`
+	Size      int64     `json:"size"`
+	PayloadID string    `json:"payloadId,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Created   time.Time `json:"created"`
+	Finished  time.Time `json:"finished"`
+
+	params *payloadParams
+}
+
+// Downloads the payloads of fetch jobs one after another in the background.
+type payloadFetcher struct {
+	client *http.Client
+	// payloads larger than this are refused
+	maxSize int64
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// guards the jobs and against queueing after Close
+	mutex    sync.Mutex
+	closed   bool
+	nextID   int
+	jobs     map[int]*fetchJob
+	finished []int
+
+	queue chan *fetchJob
+	done  chan struct{}
+}
+
+var fetcher *payloadFetcher
+
+func newPayloadFetcher(timeout time.Duration, maxSize int64) *payloadFetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f := &payloadFetcher{
+		client:  &http.Client{Timeout: timeout},
+		maxSize: maxSize,
+		ctx:     ctx,
+		cancel:  cancel,
+		nextID:  1,
+		jobs:    make(map[int]*fetchJob),
+		queue:   make(chan *fetchJob, fetchQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go f.run()
+
+	return f
+}
+
+// queue a download of 'source'; returns the job's status
+func (f *payloadFetcher) submit(source string, params *payloadParams) (fetchJob, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return fetchJob{}, errors.New("shutting down")
+	}
+
+	job := &fetchJob{
+		ID:      f.nextID,
+		URL:     source,
+		Version: params.version.String(),
+		Channel: params.channel,
+		State:   fetchQueued,
+		Size:    -1,
+		Created: time.Now().UTC(),
+		params:  params,
+	}
+
+	select {
+	case f.queue <- job:
+	default:
+		return fetchJob{}, errors.New("too many queued downloads")
+	}
+
+	f.nextID++
+	f.jobs[job.ID] = job
+	return *job, nil
+}
+
+// abort the running download, fail the queued ones and wait until that is done
+func (f *payloadFetcher) Close() {
+	f.mutex.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.queue)
+	}
+	f.mutex.Unlock()
+
+	f.cancel()
+	<-f.done
+}
+
+// status of a job, false if it is unknown
+func (f *payloadFetcher) job(id int) (fetchJob, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	job, ok := f.jobs[id]
+	if !ok {
+		return fetchJob{}, false
+	}
+	return *job, true
+}
+
+// status of all known jobs, oldest first
+func (f *payloadFetcher) list() []fetchJob {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ids := []int{}
+	for id := range f.jobs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	jobs := []fetchJob{}
+	for _, id := range ids {
+		jobs = append(jobs, *f.jobs[id])
+	}
+	return jobs
+}
+
+func (f *payloadFetcher) run() {
+	defer close(f.done)
+
+	for job := range f.queue {
+		id, err := f.fetch(job)
+
+		f.mutex.Lock()
+		job.Finished = time.Now().UTC()
+		if err != nil {
+			log.Errorf("Fetching payload %v from '%v': %v", job.Version, job.URL, err.Error())
+			job.State = fetchFailed
+			job.Error = err.Error()
+		} else {
+			log.Infof("Fetched payload %v from '%v' as %v", job.Version, job.URL, id)
+			job.State = fetchDone
+			job.PayloadID = id
+		}
+
+		f.finished = append(f.finished, job.ID)
+		if len(f.finished) > fetchHistorySize {
+			delete(f.jobs, f.finished[0])
+			f.finished = f.finished[1:]
+		}
+		f.mutex.Unlock()
+	}
+}
+
+func (f *payloadFetcher) fetch(job *fetchJob) (string, error) {
+	req, err := http.NewRequest("GET", job.URL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	f.mutex.Lock()
+	job.State = fetchDownloading
+	f.mutex.Unlock()
+
+	resp, err := f.client.Do(req.WithContext(f.ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status '%v'", resp.Status)
+	}
+	if resp.ContentLength > f.maxSize {
+		return "", fmt.Errorf("payload of %v bytes is larger than the limit of %v", resp.ContentLength, f.maxSize)
+	}
+
+	f.mutex.Lock()
+	job.Size = resp.ContentLength
+	f.mutex.Unlock()
+
+	body := io.LimitReader(resp.Body, f.maxSize+1)
+	data, err := ioutil.ReadAll(&fetchProgress{reader: body, fetcher: f, job: job})
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > f.maxSize {
+		return "", fmt.Errorf("payload is larger than the limit of %v bytes", f.maxSize)
+	}
+	if resp.ContentLength >= 0 && int64(len(data)) != resp.ContentLength {
+		return "", fmt.Errorf("received %v of %v bytes", len(data), resp.ContentLength)
+	}
+
+	f.mutex.Lock()
+	job.State = fetchStoring
+	f.mutex.Unlock()
+
+	return job.params.add(data)
+}
+
+// counts the bytes of a job's download as they are read
+type fetchProgress struct {
+	reader  io.Reader
+	fetcher *payloadFetcher
+	job     *fetchJob
+}
+
+func (p *fetchProgress) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+
+	p.fetcher.mutex.Lock()
+	p.job.Received += int64(n)
+	p.fetcher.mutex.Unlock()
+
+	return n, err
+}
+
+func addPayloadFromURLHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	source := r.URL.Query().Get("url")
+	if source == "" {
+		http.Error(w, "Missing parameter 'url'", 400)
+		return
+	}
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "Parameter 'url' must be an HTTP or HTTPS URL", 400)
+		return
+	}
+
+	params, err := parsePayloadParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if fetcher == nil {
+		http.Error(w, "Fetching payloads is not available", http.StatusServiceUnavailable)
+		return
+	}
+	job, err := fetcher.submit(source, params)
+	if err != nil {
+		log.Errorf("addPayloadFromURLHandler: queueing download of '%v': %v", source, err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/admin/fetch_jobs/%v", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(job)
+	if err != nil {
+		log.Errorf("addPayloadFromURLHandler: encoding response: %v", err.Error())
+	}
+}
+
+func fetchJobsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	jobs := []fetchJob{}
+	if fetcher != nil {
+		jobs = fetcher.list()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(jobs)
+	if err != nil {
+		log.Errorf("fetchJobsHandler: encoding response: %v", err.Error())
+	}
+}
+
+func fetchJobHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", 400)
+		return
+	}
+
+	var job fetchJob
+	ok := false
+	if fetcher != nil {
+		job, ok = fetcher.job(id)
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(job)
+	if err != nil {
+		log.Errorf("fetchJobHandler: encoding response: %v", err.Error())
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// start fetching 'source' through the admin API and wait for the job to finish
+func (s *conformanceServer) fetchPayload(source string, data []byte, version, channel string) fetchJob {
+	sha1, sha256 := payloadHashes(data)
+	params := url.Values{"url": {source}, "sha1": {sha1}, "sha256": {sha256}, "version": {version}, "channel": {channel}}
+
+	resp, err := http.Post(s.URL+"/admin/add_payload_from_url?"+params.Encode(), "", nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		s.t.Fatalf("Expected status 202, got %v", resp.StatusCode)
+	}
+
+	var job fetchJob
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	location := resp.Header.Get("Location")
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(s.URL + location)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		if job.State == fetchDone || job.State == fetchFailed {
+			return job
+		}
+	}
+
+	s.t.Fatalf("Job %+v did not finish", job)
+	return job
+}
+
+func TestFetchPayload(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+	defer func(old *payloadFetcher) { fetcher = old }(fetcher)
+	fetcher = newPayloadFetcher(time.Minute, 1024)
+	defer fetcher.Close()
+
+	data := []byte("full image of 800.0.0 on the artifact server")
+	artifacts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/800.0.0" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer artifacts.Close()
+
+	job := s.fetchPayload(artifacts.URL+"/images/800.0.0", data, "800.0.0", "stable")
+	if job.State != fetchDone || job.Error != "" || job.Received != int64(len(data)) || job.Size != int64(len(data)) || job.PayloadID == "" {
+		t.Fatalf("Unexpected job %+v", job)
+	}
+
+	images, err := db.ListImages("stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ID != job.PayloadID || images[0].Version != "800.0.0" {
+		t.Errorf("Expected the fetched payload in the channel, got %+v", images)
+	}
+	update, err := s.machine("766.4.0", "stable").Update()
+	if err != nil || update == nil || update.ID != job.PayloadID {
+		t.Errorf("Expected the fetched payload to be installed, got %+v, %v", update, err)
+	}
+
+	// missing files and data not matching the hashes are reported
+	job = s.fetchPayload(artifacts.URL+"/images/missing", data, "900.0.0", "stable")
+	if job.State != fetchFailed || job.Error == "" {
+		t.Errorf("Expected a failed job, got %+v", job)
+	}
+	job = s.fetchPayload(artifacts.URL+"/images/800.0.0", []byte("other data"), "900.0.0", "stable")
+	if job.State != fetchFailed || job.Error == "" {
+		t.Errorf("Expected a failed job, got %+v", job)
+	}
+	if images, _ := db.ListImages("stable"); len(images) != 1 {
+		t.Errorf("Expected failed jobs not to add payloads, got %+v", images)
+	}
+
+	if jobs := fetcher.list(); len(jobs) != 3 || jobs[0].ID != 1 || jobs[2].ID != 3 {
+		t.Errorf("Expected 3 jobs, got %+v", jobs)
+	}
+}
+
+func TestFetchPayloadClose(t *testing.T) {
+	f := newPayloadFetcher(time.Minute, 1024)
+
+	// the download never completes on its own
+	release := make(chan struct{})
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer source.Close()
+	defer close(release)
+
+	params := &payloadParams{sha1: "x", sha256: "y", channel: "stable"}
+	running, err := f.submit(source.URL, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := f.submit(source.URL, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	for _, id := range []int{running.ID, queued.ID} {
+		if job, _ := f.job(id); job.State != fetchFailed {
+			t.Errorf("Expected job %v to be aborted, got %+v", id, job)
+		}
+	}
+	if _, err := f.submit(source.URL, params); err == nil {
+		t.Error("Expected jobs to be refused after Close")
+	}
+}
+
+func TestFetchPayloadMaxSize(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+	defer func(old *payloadFetcher) { fetcher = old }(fetcher)
+	fetcher = newPayloadFetcher(time.Minute, 16)
+	defer fetcher.Close()
+
+	data := []byte("more than sixteen bytes")
+	artifacts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// no Content-Length, so that only the body gives the size away
+			w.Write(data[:8])
+			w.(http.Flusher).Flush()
+			w.Write(data[8:])
+			return
+		}
+		w.Write(data)
+	}))
+	defer artifacts.Close()
+
+	for _, path := range []string{"/sized", "/chunked"} {
+		job := s.fetchPayload(artifacts.URL+path, data, "800.0.0", "stable")
+		if job.State != fetchFailed || !strings.Contains(job.Error, "larger than the limit") {
+			t.Errorf("%v: expected the payload to be refused, got %+v", path, job)
+		}
+		if job.Received > 17 {
+			t.Errorf("%v: expected the download to stop at the limit, got %v bytes", path, job.Received)
+		}
+	}
+	if images, _ := db.ListImages("stable"); len(images) != 0 {
+		t.Errorf("Expected nothing to be added, got %+v", images)
+	}
+}
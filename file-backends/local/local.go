@@ -1,12 +1,17 @@
 package local
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
 )
 
+// file written by Check
+const readinessProbe = ".comaha-readiness"
+
 type localFileBackend struct {
 	path string
 }
@@ -45,12 +50,77 @@ func (b *localFileBackend) Store(data []byte) (string, error) {
 	return id, nil
 }
 
+// store a file under a given ID; it appears only once completely written
+func (b *localFileBackend) Put(id string, data []byte) error {
+	filepath := path.Join(b.path, id)
+	tmppath := path.Join(b.path, "."+id+".tmp")
+
+	err := ioutil.WriteFile(tmppath, data, 0644)
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+
+	err = os.Rename(tmppath, filepath)
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+
+	log.Debugf("FILE: saved %v bytes to file '%v'", len(data), filepath)
+
+	return nil
+}
+
+// IDs of all stored files
+func (b *localFileBackend) List() ([]string, error) {
+	entries, err := ioutil.ReadDir(b.path)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			ids = append(ids, entry.Name())
+		}
+	}
+
+	return ids, nil
+}
+
+// contents of a stored file
+func (b *localFileBackend) Get(id string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(b.path, id))
+}
+
+// remove a stored file together with what an interrupted Put left of it
 func (b *localFileBackend) Delete(id string) error {
 	filepath := path.Join(b.path, id)
 	err := os.Remove(filepath)
+
+	tmpErr := os.Remove(path.Join(b.path, "."+id+".tmp"))
+	if err == nil && tmpErr != nil && !os.IsNotExist(tmpErr) {
+		err = tmpErr
+	}
 	return err
 }
 
 func (b *localFileBackend) GetUpdateURL(localURL string) string {
 	return localURL + "/file?id="
 }
+
+// Check that the directory exists and can be written. Rather than storing and
+// removing a new file on every probe, it overwrites a single dot-file, which
+// is never a valid file ID and so neither served nor copied to mirrors.
+func (b *localFileBackend) Check() error {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%v' is not a directory", b.path)
+	}
+
+	return ioutil.WriteFile(path.Join(b.path, readinessProbe), []byte("comaha readiness probe\n"), 0644)
+}
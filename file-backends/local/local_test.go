@@ -63,3 +63,105 @@ func TestStorage(t *testing.T) {
 		t.Fatalf("Should exist but doesn't: '%v'", path2)
 	}
 }
+
+func TestCheck(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	for i := 0; i < 2; i++ {
+		err = New(tempdir).Check()
+		if err != nil {
+			t.Fatalf("Check failed on a writable directory: %v", err)
+		}
+	}
+
+	// repeated probes only ever write the one probe file
+	files, err := ioutil.ReadDir(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != readinessProbe {
+		t.Fatalf("Expected only '%v', found %v", readinessProbe, files)
+	}
+
+	err = New(path.Join(tempdir, "missing")).Check()
+	if err == nil {
+		t.Fatal("Check should fail on a missing directory")
+	}
+	err = New(path.Join(tempdir, readinessProbe)).Check()
+	if err == nil {
+		t.Fatal("Check should fail on a file")
+	}
+}
+
+func TestPutList(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	b := New(tempdir)
+
+	err = b.Put("first", testdata1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Put("second", testdata2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(tempdir, "first"))
+	if err != nil || string(data) != string(testdata1) {
+		t.Fatalf("Unexpected contents of 'first': %v", err)
+	}
+
+	ids, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != "first" || ids[1] != "second" {
+		t.Fatalf("Expected files 'first' and 'second', got %v", ids)
+	}
+}
+
+func TestGetDelete(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	b := New(tempdir)
+
+	err = b.Put("first", testdata1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := b.Get("first")
+	if err != nil || string(data) != string(testdata1) {
+		t.Fatalf("Unexpected contents of 'first': %v", err)
+	}
+
+	// left over by a Put which was interrupted
+	tmppath := path.Join(tempdir, ".first.tmp")
+	err = ioutil.WriteFile(tmppath, testdata2, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Delete("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmppath); !os.IsNotExist(err) {
+		t.Errorf("Shouldn't exist but does: '%v'", tmppath)
+	}
+	if _, err := b.Get("first"); !os.IsNotExist(err) {
+		t.Errorf("Expected 'first' to be deleted, got %v", err)
+	}
+}
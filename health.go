@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how long a readiness check may take before it is reported as failed
+const readinessCheckTimeout = 5 * time.Second
+
+type readinessCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Status string                    `json:"status"`
+	Checks map[string]readinessCheck `json:"checks"`
+}
+
+// dependencies which have to work for the server to be ready
+var readinessChecks = map[string]func() error{
+	"database": func() error {
+		return db.Ping()
+	},
+	"file_backend": func() error {
+		return fileBE.Check()
+	},
+	"templates": func() error {
+		_, err := loadPanelTemplate()
+		return err
+	},
+}
+
+// run all readiness checks in parallel
+func checkReadiness() readiness {
+	result := readiness{Status: "ready", Checks: make(map[string]readinessCheck)}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range readinessChecks {
+		wg.Add(1)
+		go func(name string, check func() error) {
+			defer wg.Done()
+
+			done := make(chan error, 1)
+			go func() { done <- check() }()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(readinessCheckTimeout):
+				err = errors.New("timed out")
+			}
+
+			status := readinessCheck{Status: "ok"}
+			if err != nil {
+				status = readinessCheck{Status: "error", Error: err.Error()}
+			}
+
+			mutex.Lock()
+			result.Checks[name] = status
+			if err != nil {
+				result.Status = "not ready"
+			}
+			mutex.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	return result
+}
+
+// the process is alive and serving requests
+func healthzHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	fmt.Fprintln(w, "ok")
+}
+
+// the database, file backend and templates work; 503 otherwise
+func readyzHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	result := checkReadiness()
+	if result.Status != "ready" {
+		for name, check := range result.Checks {
+			if check.Status != "ok" {
+				log.Warnf("readyzHandler: %v check failed: %v", name, check.Error)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if result.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Errorf("readyzHandler: encoding response: %v", err.Error())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/kdomanski/comaha/file-backends/local"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func getReadiness(t *testing.T) (int, readiness) {
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil), nil)
+
+	var result readiness
+	err := json.NewDecoder(w.Body).Decode(&result)
+	if err != nil {
+		t.Fatalf("Decoding readiness: %v", err.Error())
+	}
+
+	return w.Code, result
+}
+
+func TestReadiness(t *testing.T) {
+	defer func(staticDir string, oldBE fileBackend, oldDB userDB) {
+		opts.StaticDir, fileBE, db = staticDir, oldBE, oldDB
+	}(opts.StaticDir, fileBE, db)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+
+	tempdir, err := ioutil.TempDir("", "comaha-readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	fileBE = local.New(tempdir)
+	opts.StaticDir = "static"
+
+	code, result := getReadiness(t)
+	if code != http.StatusOK || result.Status != "ready" {
+		t.Errorf("Expected to be ready, got %v: %+v", code, result)
+	}
+	for _, name := range []string{"database", "file_backend", "templates"} {
+		if result.Checks[name].Status != "ok" {
+			t.Errorf("Expected check '%v' to pass, got %+v", name, result.Checks[name])
+		}
+	}
+
+	// a missing storage directory makes the server unready
+	fileBE = local.New(path.Join(tempdir, "missing"))
+
+	code, result = getReadiness(t)
+	if code != http.StatusServiceUnavailable || result.Status != "not ready" {
+		t.Errorf("Expected not to be ready, got %v: %+v", code, result)
+	}
+	if check := result.Checks["file_backend"]; check.Status != "error" || check.Error == "" {
+		t.Errorf("Expected the file backend check to fail, got %+v", check)
+	}
+	if check := result.Checks["database"]; check.Status != "ok" {
+		t.Errorf("Expected the database check to pass, got %+v", check)
+	}
+}
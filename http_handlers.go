@@ -3,8 +3,12 @@ package main
 import (
 	"crypto/sha1"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/go-omaha/omaha"
@@ -13,10 +17,23 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path"
+	"regexp"
 	"runtime"
+	"strconv"
+	"time"
 )
 
+// IDs of stored files as accepted by fileHandler
+var validFileID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// number of requests shown in a machine's history unless specified otherwise
+const defaultRequestHistoryLimit = 100
+
+// page size of the event log unless specified otherwise
+const defaultEventsPerPage = 100
+
 const noupdateResponse = `
 <?xml version="1.0" encoding="UTF-8"?>
 <response protocol="3.0" server="update.core-os.net">
@@ -39,14 +56,243 @@ func fileHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Infof("Someone tried to access '%s'", r.URL.String())
 
 	fileid := r.URL.Query().Get("id")
-	log.Infof("Handling request for %v", fileid)
-	http.ServeFile(w, r, path.Join("storage", fileid))
+	log.Infof("Handling request for %v from %v", fileid, clientIP(r))
+
+	// only names of stored files, which never contain path separators or dots
+	if !validFileID.MatchString(fileid) {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	exists, err := db.FileExists(fileid)
+	if err != nil {
+		log.Errorf("fileHandler: looking up file '%v': %v", fileid, err.Error())
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeFile(w, r, path.Join(opts.LocalStorageDir, fileid))
+}
+
+// returned by verifyPayloadHashes when the data does not match
+type hashMismatchError struct {
+	msg string
+}
+
+func (e *hashMismatchError) Error() string {
+	return e.msg
+}
+
+// calculate base64-encoded hashes of 'data' and compare them with the expected ones
+func verifyPayloadHashes(data []byte, expectedSha1, expectedSha256 string) (string, string, error) {
+	rawSha1 := sha1.Sum(data)
+	calculatedSha1 := base64.StdEncoding.EncodeToString(rawSha1[:])
+	rawSha256 := sha256.Sum256(data)
+	calculatedSha256 := base64.StdEncoding.EncodeToString(rawSha256[:])
+
+	if expectedSha1 != calculatedSha1 {
+		return "", "", &hashMismatchError{fmt.Sprintf("SHA1 validation failed, '%v' != '%v'", expectedSha1, calculatedSha1)}
+	}
+
+	if expectedSha256 != calculatedSha256 {
+		return "", "", &hashMismatchError{fmt.Sprintf("SHA256 validation failed, '%v' != '%v'", expectedSha256, calculatedSha256)}
+	}
+
+	return calculatedSha1, calculatedSha256, nil
+}
+
+// description of a new payload in the query of /admin/add_payload
+type payloadParams struct {
+	sha1         string
+	sha256       string
+	version      payloadVersion
+	channel      string
+	minSource    *payloadVersion
+	requiredStop bool
+}
+
+func parsePayloadParams(query url.Values) (*payloadParams, error) {
+	p := &payloadParams{
+		sha1:    query.Get("sha1"),
+		sha256:  query.Get("sha256"),
+		channel: query.Get("channel"),
+	}
+
+	if p.sha1 == "" {
+		return nil, errors.New("Missing parameter 'sha1'")
+	}
+	if p.sha256 == "" {
+		return nil, errors.New("Missing parameter 'sha256'")
+	}
+	versionString := query.Get("version")
+	if versionString == "" {
+		return nil, errors.New("Missing parameter 'version'")
+	}
+	if p.channel == "" {
+		return nil, errors.New("Missing parameter 'channel'")
+	}
+
+	var err error
+	p.version, err = parseVersionString(versionString)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse 'version': %v", err.Error())
+	}
+
+	if minSourceString := query.Get("min_source_version"); minSourceString != "" {
+		v, err := parseVersionString(minSourceString)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse 'min_source_version': %v", err.Error())
+		}
+		p.minSource = &v
+	}
+
+	switch query.Get("required_stop") {
+	case "", "0":
+	case "1":
+		p.requiredStop = true
+	default:
+		return nil, errors.New("Parameter 'required_stop' must be '0' or '1'")
+	}
+
+	return p, nil
 }
 
 func addPayloadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	defer runtime.GC()
 	defer r.Body.Close()
 
+	params, err := parsePayloadParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	data, ok := readUploadBody(w, r)
+	if !ok {
+		return
+	}
+
+	log.Debugf("addPayloadHandler: received size is %v", len(data))
+
+	_, err = params.add(data)
+	if _, ok := err.(*hashMismatchError); ok {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+// Read the body of a payload or delta upload, which must announce its size
+// within --max-payload-size. Otherwise the request is answered and false
+// returned.
+func readUploadBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length required", http.StatusLengthRequired)
+		return nil, false
+	}
+	if r.ContentLength > opts.MaxPayloadSize {
+		s := fmt.Sprintf("Upload of %v bytes exceeds the limit of %v", r.ContentLength, opts.MaxPayloadSize)
+		http.Error(w, s, http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	data := make([]byte, r.ContentLength)
+	_, err := io.ReadFull(r.Body, data)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil, false
+	}
+
+	return data, true
+}
+
+// add 'data' as the payload described by the parameters, see addPayload
+func (p *payloadParams) add(data []byte) (string, error) {
+	return addPayload(data, p.sha1, p.sha256, p.version, p.channel, p.minSource, p.requiredStop)
+}
+
+// Verify 'data' against the expected hashes, store it and add it to 'channel'
+// with the given upgrade path constraints. Returns the ID of the new payload,
+// or a *hashMismatchError if the data does not match.
+func addPayload(data []byte, expectedSha1, expectedSha256 string, version payloadVersion, channel string, minSource *payloadVersion, requiredStop bool) (string, error) {
+	calculatedSha1, calculatedSha256, err := verifyPayloadHashes(data, expectedSha1, expectedSha256)
+	if err != nil {
+		return "", err
+	}
+
+	size := int64(len(data))
+	id, err := fileBE.Store(data)
+	if err != nil {
+		log.Errorf("addPayload: storing data: %v", err.Error())
+		return "", err
+	}
+	err = db.AddPayload(id, calculatedSha1, calculatedSha256, size, version)
+	if err != nil {
+		log.Errorf("addPayload: adding payload to db: %v", err.Error())
+		discardPayload(id, channel, false)
+		return "", err
+	}
+
+	// without its constraints, the payload must not be offered at all
+	if minSource != nil {
+		err = db.SetPayloadMinSourceVersion(id, minSource)
+		if err != nil {
+			log.Errorf("addPayload: setting minimum source version: %v", err.Error())
+			discardPayload(id, channel, true)
+			return "", err
+		}
+	}
+
+	if requiredStop {
+		err = db.SetPayloadRequiredStop(id, true)
+		if err != nil {
+			log.Errorf("addPayload: marking payload as required stop: %v", err.Error())
+			discardPayload(id, channel, true)
+			return "", err
+		}
+	}
+
+	err = db.AttachPayloadToChannel(id, channel)
+	if err != nil {
+		log.Errorf("addPayload: adding payload to channel: %v", err.Error())
+		discardPayload(id, channel, true)
+		return "", err
+	}
+
+	requestMirrorSync()
+	notify(webhookPayloadAdded, map[string]interface{}{"id": id, "channel": channel, "version": version.String(), "size": size})
+
+	return id, nil
+}
+
+// remove the file and, if 'inDB', the database entry of a payload which
+// could not be added completely
+func discardPayload(id, channel string, inDB bool) {
+	if inDB {
+		err := db.DeletePayload(id, channel)
+		if err != nil {
+			log.Errorf("addPayload: removing DB entry for '%v': %v", id, err.Error())
+			return
+		}
+	}
+
+	err := fileBE.Delete(id)
+	if err != nil {
+		log.Errorf("addPayload: removing file for '%v': %v", id, err.Error())
+	}
+}
+
+func addDeltaHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer runtime.GC()
+	defer r.Body.Close()
+
 	receivedSha1 := r.URL.Query().Get("sha1")
 	if receivedSha1 == "" {
 		http.Error(w, "Missing parameter 'sha1'", 400)
@@ -57,62 +303,87 @@ func addPayloadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 		http.Error(w, "Missing parameter 'sha256'", 400)
 		return
 	}
-	size := r.ContentLength
-	versionString := r.URL.Query().Get("version")
-	if versionString == "" {
-		http.Error(w, "Missing parameter 'version'", 400)
+	sourceString := r.URL.Query().Get("source_version")
+	if sourceString == "" {
+		http.Error(w, "Missing parameter 'source_version'", 400)
 		return
 	}
-	channel := r.URL.Query().Get("channel")
-	if channel == "" {
-		http.Error(w, "Missing parameter 'channel'", 400)
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Missing parameter 'target'", 400)
 		return
 	}
-	data := make([]byte, size)
-	rcvsize, err := io.ReadFull(r.Body, data)
+
+	sourceVersion, err := parseVersionString(sourceString)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		s := fmt.Sprintf("Could not parse 'source_version': %v", err.Error())
+		http.Error(w, s, 400)
 		return
 	}
 
-	versionData, err := parseVersionString(versionString)
-	if err != nil {
-		s := fmt.Sprintf("Could not parse 'version': %v", err.Error())
+	if !db.PayloadExists(target) {
+		s := fmt.Sprintf("Target payload '%v' does not exist", target)
 		http.Error(w, s, 400)
 		return
 	}
 
-	log.Debugf("addPayloadHandler: received size is %v", rcvsize)
+	data, ok := readUploadBody(w, r)
+	if !ok {
+		return
+	}
+	size := int64(len(data))
 
-	rawSha1 := sha1.Sum(data)
-	calculatedSha1 := base64.StdEncoding.EncodeToString(rawSha1[:])
-	rawSha256 := sha256.Sum256(data)
-	calculatedSha256 := base64.StdEncoding.EncodeToString(rawSha256[:])
+	log.Debugf("addDeltaHandler: received size is %v", size)
 
-	if receivedSha1 != calculatedSha1 {
-		s := fmt.Sprintf("SHA1 validation failed, '%v' != '%v'", receivedSha1, calculatedSha1)
-		http.Error(w, s, 400)
+	calculatedSha1, calculatedSha256, err := verifyPayloadHashes(data, receivedSha1, receivedSha256)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
-	if receivedSha256 != calculatedSha256 {
-		s := fmt.Sprintf("SHA256 validation failed, '%v' != '%v'", receivedSha256, calculatedSha256)
-		http.Error(w, s, 400)
+	id, err := fileBE.Store(data)
+	if err != nil {
+		log.Errorf("addDeltaHandler: storing data: %v", err.Error())
+		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	id, err := fileBE.Store(data)
+	err = db.AddDelta(id, calculatedSha1, calculatedSha256, size, sourceVersion, target)
 	if err != nil {
-		log.Errorf("addPayloadHandler: storing data: %v", err.Error())
+		log.Errorf("addDeltaHandler: adding delta to db: %v", err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	requestMirrorSync()
+}
+
+func deleteDeltaHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing parameter 'id'", 400)
+		return
+	}
+
+	// never remove the file of anything else, e.g. a payload
+	err := db.DeleteDelta(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("No such delta '%v'", id), 404)
+		return
 	}
-	err = db.AddPayload(id, calculatedSha1, calculatedSha256, size, versionData)
 	if err != nil {
-		log.Errorf("addPayloadHandler: adding payload to db: %v", err.Error())
+		log.Errorf("deleteDeltaHandler: removing DB entry for '%v': %v", id, err.Error())
+		http.Error(w, err.Error(), 500)
+		return
 	}
+	requestMirrorSync()
 
-	err = db.AttachPayloadToChannel(id, channel)
+	err = fileBE.Delete(id)
 	if err != nil {
-		log.Errorf("addPayloadHandler: adding payload to channel: %v", err.Error())
+		log.Errorf("deleteDeltaHandler: removing file for '%v': %v", id, err.Error())
+		http.Error(w, err.Error(), 500)
 	}
 }
 
@@ -133,7 +404,74 @@ func attachPayloadToChannelHandler(w http.ResponseWriter, r *http.Request, _ htt
 	if err != nil {
 		log.Errorf("addPayloadHandler: adding payload to channel: %v", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	notify(webhookPayloadAttached, map[string]interface{}{"id": payload, "channel": channel})
+}
+
+func yankPayloadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing parameter 'id'", 400)
+		return
+	}
+
+	channel := r.URL.Query().Get("channel")
+	if channel == "" {
+		http.Error(w, "Missing parameter 'channel'", 400)
+		return
+	}
+
+	var downgrade bool
+	switch r.URL.Query().Get("downgrade") {
+	case "", "0":
+	case "1":
+		downgrade = true
+	default:
+		http.Error(w, "Parameter 'downgrade' must be '0' or '1'", 400)
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+
+	err := db.YankPayload(id, channel, reason, downgrade)
+	if err != nil {
+		log.Errorf("yankPayloadHandler: yanking '%v' from channel '%v': %v", id, channel, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Payload '%v' yanked from channel '%v': %v", id, channel, reason)
+	notify(webhookPayloadYanked, map[string]interface{}{"id": id, "channel": channel, "reason": reason, "downgrade": downgrade})
+}
+
+func unyankPayloadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing parameter 'id'", 400)
+		return
+	}
+
+	channel := r.URL.Query().Get("channel")
+	if channel == "" {
+		http.Error(w, "Missing parameter 'channel'", 400)
+		return
+	}
+
+	err := db.UnyankPayload(id, channel)
+	if err != nil {
+		log.Errorf("unyankPayloadHandler: restoring '%v' in channel '%v': %v", id, channel, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	log.Infof("Payload '%v' restored in channel '%v'", id, channel)
+	notify(webhookPayloadUnyanked, map[string]interface{}{"id": id, "channel": channel})
 }
 
 func deletePayloadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -155,6 +493,9 @@ func deletePayloadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	if err != nil {
 		log.Errorf("deletePayloadHandler: removing DB entry for '%v' from channel '%v': %v", id, channel, err.Error())
 		http.Error(w, err.Error(), 500)
+	} else {
+		requestMirrorSync()
+		notify(webhookPayloadDeleted, map[string]interface{}{"id": id, "channel": channel})
 	}
 
 	if !db.PayloadExists(id) {
@@ -163,6 +504,59 @@ func deletePayloadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.P
 			log.Errorf("deletePayloadHandler: removing file for '%v': %v", id, err.Error())
 			http.Error(w, err.Error(), 500)
 		}
+
+		// deltas are useless without their target
+		deltas, err := db.ListDeltas(id)
+		if err != nil {
+			log.Errorf("deletePayloadHandler: listing deltas for '%v': %v", id, err.Error())
+			return
+		}
+		for _, d := range deltas {
+			err = db.DeleteDelta(d.ID)
+			if err != nil {
+				log.Errorf("deletePayloadHandler: removing DB entry for delta '%v': %v", d.ID, err.Error())
+				continue
+			}
+			err = fileBE.Delete(d.ID)
+			if err != nil {
+				log.Errorf("deletePayloadHandler: removing file for delta '%v': %v", d.ID, err.Error())
+			}
+		}
+	}
+}
+
+func channelsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	channels, err := db.ListChannels()
+	if err != nil {
+		log.Errorf("channelsHandler: listing channels: %v", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(channels)
+	if err != nil {
+		log.Errorf("channelsHandler: encoding response: %v", err.Error())
+	}
+}
+
+func channelImagesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+
+	channel := ps.ByName("channel")
+	images, err := db.ListImages(channel)
+	if err != nil {
+		log.Errorf("channelImagesHandler: listing images of channel '%v': %v", channel, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(images)
+	if err != nil {
+		log.Errorf("channelImagesHandler: encoding response: %v", err.Error())
 	}
 }
 
@@ -198,53 +592,178 @@ func channelForceDowngradePostHandler(w http.ResponseWriter, r *http.Request, ps
 	default:
 		s := fmt.Sprintf("Invalid value '%v'", value)
 		http.Error(w, s, http.StatusBadRequest)
+		return
 	}
 
 	err = db.SetChannelForceDowngrade(channel, boolValue)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	notify(webhookForceDowngrade, map[string]interface{}{"channel": channel, "enabled": boolValue})
 }
 
-func updateHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func payloadMinSourceVersionPostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
 	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// an empty body clears the constraint
+	var version *payloadVersion
+	if value := string(body); value != "" {
+		v, err := parseVersionString(value)
+		if err != nil {
+			s := fmt.Sprintf("Invalid version '%v': %v", value, err.Error())
+			http.Error(w, s, http.StatusBadRequest)
+			return
+		}
+		version = &v
+	}
+
+	err = db.SetPayloadMinSourceVersion(id, version)
+	if err != nil {
+		log.Errorf("payloadMinSourceVersionPostHandler: setting value for payload '%v': %v", id, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	log.Infof("Handling an update request from %v", r.RemoteAddr)
+func payloadRequiredStopPostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
 
+	defer r.Body.Close()
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	value := string(body)
+
+	var boolValue bool
+	switch value {
+	case "1":
+		boolValue = true
+	case "0":
+		boolValue = false
+	default:
+		s := fmt.Sprintf("Invalid value '%v'", value)
+		http.Error(w, s, http.StatusBadRequest)
+		return
+	}
+
+	err = db.SetPayloadRequiredStop(id, boolValue)
+	if err != nil {
+		log.Errorf("payloadRequiredStopPostHandler: setting value for payload '%v': %v", id, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Response to an update request which could not be processed at all. The
+// status values follow the naming of the Omaha protocol's app statuses.
+type omahaErrorResponse struct {
+	XMLName  xml.Name `xml:"response"`
+	Protocol string   `xml:"protocol,attr"`
+	Server   string   `xml:"server,attr"`
+	Status   string   `xml:"status,attr"`
+}
+
+func writeOmahaError(w http.ResponseWriter, server, status string, code int) {
+	data, err := xml.Marshal(omahaErrorResponse{Protocol: "3.0", Server: server, Status: status})
+	if err != nil {
+		log.Errorf("writeOmahaError: encoding response: %v", err.Error())
+		http.Error(w, status, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func updateHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	remoteAddr := clientIP(r)
+	log.Infof("Handling an update request from %v", remoteAddr)
+
+	if updateLimiter != nil {
+		allowed, retryAfter := updateLimiter.allow(remoteAddr, time.Now())
+		if !allowed {
+			log.Warnf("Client '%v' exceeded the update request rate", remoteAddr)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+			writeOmahaError(w, r.Host, "error-rateLimited", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if r.ContentLength > opts.MaxUpdateRequestSize {
+		log.Errorf("Client '%v' sent an update request of %v bytes", remoteAddr, r.ContentLength)
+		writeOmahaError(w, r.Host, "error-requestTooLarge", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// read one byte more than allowed to tell whether the limit was exceeded
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, opts.MaxUpdateRequestSize+1))
+	if err != nil {
+		log.Errorf("Reading the update request of client '%v': %v", remoteAddr, err.Error())
+		writeOmahaError(w, r.Host, "error-invalidRequest", http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > opts.MaxUpdateRequestSize {
+		log.Errorf("Client '%v' sent an update request larger than %v bytes", remoteAddr, opts.MaxUpdateRequestSize)
+		writeOmahaError(w, r.Host, "error-requestTooLarge", http.StatusRequestEntityTooLarge)
+		return
 	}
 
 	var reqStructure omaha.Request
 	log.Debugf("%v", string(body[:len(body)]))
 	err = xml.Unmarshal(body, &reqStructure)
+	if err != nil {
+		log.Errorf("Client '%v' sent malformed XML: %v", remoteAddr, err.Error())
+		writeOmahaError(w, r.Host, "error-invalidRequest", http.StatusBadRequest)
+		return
+	}
 
 	if n := len(reqStructure.Apps); n != 1 {
-		log.Errorf("Client '%v' tried to update %v services", r.RemoteAddr, n)
-		http.Error(w, "I can handle only 1 app update.", 400)
+		log.Errorf("Client '%v' tried to update %v services", remoteAddr, n)
+		writeOmahaError(w, r.Host, "error-invalidRequest", http.StatusBadRequest)
 		return
 	}
 
 	log.Debugf("%#v", reqStructure)
 
 	logContext := log.WithFields(log.Fields{
-		"remoteAddr": r.RemoteAddr,
+		"remoteAddr": remoteAddr,
 	})
 
 	// protocol and hostname for local storage URL building
-	scheme := "http"
-	if h := r.Header.Get("X-Forwarded-Proto"); h != "" {
-		scheme = h
-	}
-	localUrl := fmt.Sprintf("%v://%v", scheme, r.Host)
+	localUrl := publicBaseURL(r)
 
 	resp := omaha.NewResponse(r.Host)
 	for _, appReq := range reqStructure.Apps {
 		appResponse := resp.AddApp(appReq.Id)
-		handleApiApp(logContext, localUrl, appReq, appResponse)
+
+		record := ClientRequest{
+			RemoteAddr: remoteAddr,
+			OSPlatform: reqStructure.Os.Platform,
+			OSVersion:  reqStructure.Os.Version,
+			OSSP:       reqStructure.Os.Sp,
+			OSArch:     reqStructure.Os.Arch,
+		}
+		handleApiApp(logContext, localUrl, appReq, appResponse, &record)
+
+		err = db.LogRequest(record, opts.RequestLogSize)
+		if err != nil {
+			logContext.Errorf("Failed to record the request: %v", err.Error())
+		}
+		broadcast(liveUpdateCheck, record)
 	}
 
 	data, err := xml.MarshalIndent(resp, "", "  ")
@@ -257,27 +776,388 @@ func updateHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	w.Write(data)
 }
 
-func panelHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func webhookDeadLettersHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	defer r.Body.Close()
 
-	// TODO log panel access
+	letters, err := db.GetWebhookDeadLetters()
+	if err != nil {
+		log.Errorf("webhookDeadLettersHandler: getting dead letters: %v", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	data, err := ioutil.ReadFile("static/images.html")
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(letters)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		log.Error(err.Error())
+		log.Errorf("webhookDeadLettersHandler: encoding response: %v", err.Error())
+	}
+}
+
+func eventQueueHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	var status eventQueueStatus
+	if eventLog != nil {
+		status = eventLog.status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		log.Errorf("eventQueueHandler: encoding response: %v", err.Error())
+	}
+}
+
+func machinesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	machines, err := db.ListMachines()
+	if err != nil {
+		log.Errorf("machinesHandler: listing machines: %v", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(machines)
+	if err != nil {
+		log.Errorf("machinesHandler: encoding response: %v", err.Error())
+	}
+}
+
+func machineRequestsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+
+	machineID := ps.ByName("machine")
+
+	limit := defaultRequestHistoryLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			s := fmt.Sprintf("Invalid limit '%v'", l)
+			http.Error(w, s, http.StatusBadRequest)
+			return
+		}
+	}
+
+	requests, err := db.GetRequests(machineID, limit)
+	if err != nil {
+		log.Errorf("machineRequestsHandler: getting requests of machine '%v': %v", machineID, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(requests)
+	if err != nil {
+		log.Errorf("machineRequestsHandler: encoding response: %v", err.Error())
+	}
+}
+
+// an event with its type and result decoded for humans
+type namedEvent struct {
+	Event
+	TypeName   string
+	ResultName string
+}
+
+func nameEvents(events []Event) []namedEvent {
+	out := make([]namedEvent, 0, len(events))
+	for _, ev := range events {
+		out = append(out, namedEvent{ev, eventTypeName(ev.Type), eventResultName(ev.Result)})
+	}
+	return out
+}
+
+// accepts RFC 3339 timestamps, plain dates and unix time
+func parseTimeParameter(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time '%v'", s)
+}
+
+func parseEventFilter(query url.Values) (EventFilter, error) {
+	filter := EventFilter{
+		MachineID: query.Get("machine"),
+		Channel:   query.Get("channel"),
+		Version:   query.Get("version"),
+		PayloadID: query.Get("payload"),
+		Page:      1,
+		PerPage:   defaultEventsPerPage,
+	}
+
+	if s := query.Get("type"); s != "" {
+		evType, err := parseEventType(s)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid event type '%v'", s)
+		}
+		filter.Type = &evType
+	}
+
+	if s := query.Get("result"); s != "" {
+		evResult, err := parseEventResult(s)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid event result '%v'", s)
+		}
+		filter.Result = &evResult
+	}
+
+	var err error
+	if s := query.Get("since"); s != "" {
+		filter.Since, err = parseTimeParameter(s)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	if s := query.Get("until"); s != "" {
+		filter.Until, err = parseTimeParameter(s)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	if s := query.Get("page"); s != "" {
+		filter.Page, err = strconv.Atoi(s)
+		if err != nil || filter.Page < 1 {
+			return filter, fmt.Errorf("Invalid page '%v'", s)
+		}
+	}
+
+	if s := query.Get("per_page"); s != "" {
+		filter.PerPage, err = strconv.Atoi(s)
+		if err != nil || filter.PerPage < 0 {
+			return filter, fmt.Errorf("Invalid per_page '%v'", s)
+		}
+	}
+
+	return filter, nil
+}
+
+// a single page of the event log as shown in the panel
+type eventPage struct {
+	Events []namedEvent
+	Query  url.Values
+	Total  int
+	Page   int
+	Pages  int
+
+	PrevURL    template.URL
+	NextURL    template.URL
+	ExportJSON template.URL
+	ExportCSV  template.URL
+}
+
+func getEventPage(filter EventFilter, query url.Values) (*eventPage, error) {
+	events, err := db.GetEvents(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := db.CountEvents(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &eventPage{
+		Events: nameEvents(events),
+		Query:  query,
+		Total:  total,
+		Page:   filter.Page,
+		Pages:  1,
+	}
+	if filter.PerPage > 0 && total > 0 {
+		page.Pages = (total + filter.PerPage - 1) / filter.PerPage
+	}
+
+	withPage := func(n int) template.URL {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("page", strconv.Itoa(n))
+		return template.URL("/panel?" + q.Encode())
+	}
+	if page.Page > 1 {
+		page.PrevURL = withPage(page.Page - 1)
+	}
+	if page.Page < page.Pages {
+		page.NextURL = withPage(page.Page + 1)
+	}
+
+	// exports contain all matching events
+	export := url.Values{}
+	for k, v := range query {
+		export[k] = v
+	}
+	export.Del("events")
+	export.Del("page")
+	export.Set("per_page", "0")
+	export.Set("format", "json")
+	page.ExportJSON = template.URL("/admin/events?" + export.Encode())
+	export.Set("format", "csv")
+	page.ExportCSV = template.URL("/admin/events?" + export.Encode())
+
+	return page, nil
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := db.GetEvents(filter)
+	if err != nil {
+		log.Errorf("eventsHandler: getting events: %v", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	total, err := db.CountEvents(filter)
+	if err != nil {
+		log.Errorf("eventsHandler: counting events: %v", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(nameEvents(events))
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=events.csv")
+		err = writeEventsCSV(w, nameEvents(events))
+	default:
+		s := fmt.Sprintf("Unknown format '%v'", format)
+		http.Error(w, s, http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.Errorf("eventsHandler: encoding response: %v", err.Error())
+	}
+}
+
+func writeEventsCSV(w io.Writer, events []namedEvent) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write([]string{"timestamp", "machine_id", "channel", "version", "previous_version", "payload_id", "type", "result", "error_code"})
+	if err != nil {
+		return err
+	}
+
+	for _, ev := range events {
+		err = cw.Write([]string{ev.Timestamp, ev.MachineID, ev.Channel, ev.Version, ev.PreviousVersion, ev.PayloadID, ev.TypeName, ev.ResultName, strconv.Itoa(ev.ErrorCode)})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func eventAggregatesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	aggregates, err := db.GetEventAggregates(r.URL.Query().Get("channel"))
+	if err != nil {
+		log.Errorf("eventAggregatesHandler: getting aggregates: %v", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type namedAggregate struct {
+		EventAggregate
+		TypeName   string
+		ResultName string
+	}
+
+	out := []namedAggregate{}
+	for _, a := range aggregates {
+		out = append(out, namedAggregate{a, eventTypeName(a.Type), eventResultName(a.Result)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(out)
+	if err != nil {
+		log.Errorf("eventAggregatesHandler: encoding response: %v", err.Error())
+	}
+}
+
+func releaseStatsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	stats, err := db.GetReleaseStats()
+	if err != nil {
+		log.Errorf("releaseStatsHandler: getting stats: %v", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type releaseStatsWithRate struct {
+		ReleaseStats
+		SuccessRate float64
+	}
+
+	out := []releaseStatsWithRate{}
+	for _, s := range stats {
+		out = append(out, releaseStatsWithRate{s, s.SuccessRate()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(out)
+	if err != nil {
+		log.Errorf("releaseStatsHandler: encoding response: %v", err.Error())
+	}
+}
+
+func loadPanelTemplate() (*template.Template, error) {
+	data, err := ioutil.ReadFile(path.Join(opts.StaticDir, "images.html"))
+	if err != nil {
+		return nil, err
+	}
+
 	funcMap := template.FuncMap{
 		"toMB": func(i int64) string {
 			divided := float32(i) / 1048576
 			formatted := fmt.Sprintf("%.1f", divided)
 			return formatted
 		},
+		"eventTypes": func() []string {
+			return []string{"download", "arrive", "apply", "success"}
+		},
+		"eventResults": func() []string {
+			return []string{"error", "ok", "done"}
+		},
+		"percent": func(f float64) string {
+			return fmt.Sprintf("%.1f%%", f*100)
+		},
 	}
 
-	t, err := template.New("images").Funcs(funcMap).Parse(string(data))
+	return template.New("images").Funcs(funcMap).Parse(string(data))
+}
+
+func panelHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	// TODO log panel access
+
+	t, err := loadPanelTemplate()
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		log.Error(err.Error())
@@ -294,10 +1174,37 @@ func panelHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	var chosenChannel string
 	var forceDowngrade bool
 	var images []payload
-	var events []Event
+	var deltas map[string][]delta
+	var eventLog *eventPage
+	var releases []ReleaseStats
+	var live bool
+	var machineID string
+	var requests []ClientRequest
 
-	if _, ok := r.URL.Query()["events"]; ok {
-		events, err = db.GetEvents()
+	if machineID = r.URL.Query().Get("machine"); machineID != "" {
+		requests, err = db.GetRequests(machineID, defaultRequestHistoryLimit)
+		if err != nil {
+			log.Error(err.Error())
+			http.Error(w, "Failed to retrieve the machine's requests from the database", 500)
+			return
+		}
+	} else if _, ok := r.URL.Query()["live"]; ok {
+		live = true
+	} else if _, ok := r.URL.Query()["releases"]; ok {
+		releases, err = db.GetReleaseStats()
+		if err != nil {
+			log.Error(err.Error())
+			http.Error(w, "Failed to retrieve release statistics from the database", 500)
+			return
+		}
+	} else if _, ok := r.URL.Query()["events"]; ok {
+		filter, err := parseEventFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		eventLog, err = getEventPage(filter, r.URL.Query())
 		if err != nil {
 			log.Error(err.Error())
 			http.Error(w, "Failed to retrieve events from the database", 500)
@@ -322,17 +1229,37 @@ func panelHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 			http.Error(w, "Failed to retrieve images for the channel", 500)
 			return
 		}
+
+		deltas = make(map[string][]delta)
+		for _, image := range images {
+			deltas[image.ID], err = db.ListDeltas(image.ID)
+			if err != nil {
+				log.Error(err.Error())
+				http.Error(w, "Failed to retrieve deltas for the channel", 500)
+				return
+			}
+		}
 	}
 
 	panelData := struct {
 		Images         []payload
-		Events         []Event
+		Deltas         map[string][]delta
+		EventLog       *eventPage
+		Releases       []ReleaseStats
+		Live           bool
+		MachineID      string
+		Requests       []ClientRequest
 		Channels       []string
 		CurrentChannel string
 		ForceDowngrade bool
 	}{
 		images,
-		events,
+		deltas,
+		eventLog,
+		releases,
+		live,
+		machineID,
+		requests,
 		channels,
 		chosenChannel,
 		forceDowngrade,
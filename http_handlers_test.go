@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postUpdate(body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/update", strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:4711"
+	w := httptest.NewRecorder()
+	updateHandler(w, r, nil)
+	return w
+}
+
+func expectOmahaError(t *testing.T, w *httptest.ResponseRecorder, code int, status string) {
+	if w.Code != code {
+		t.Errorf("Expected HTTP %v, got %v", code, w.Code)
+	}
+
+	var resp omahaErrorResponse
+	err := xml.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("Decoding error response: %v", err.Error())
+	}
+	if resp.Status != status || resp.Protocol != "3.0" {
+		t.Errorf("Expected status '%v', got %+v", status, resp)
+	}
+}
+
+func TestUpdateHandlerRejectsBadRequests(t *testing.T) {
+	defer func(size int64, limiter *rateLimiter) { opts.MaxUpdateRequestSize, updateLimiter = size, limiter }(opts.MaxUpdateRequestSize, updateLimiter)
+	opts.MaxUpdateRequestSize = 1024
+	updateLimiter = nil
+
+	expectOmahaError(t, postUpdate("<request protocol=\"3.0\"><app"), http.StatusBadRequest, "error-invalidRequest")
+	expectOmahaError(t, postUpdate("<request protocol=\"3.0\"></request>"), http.StatusBadRequest, "error-invalidRequest")
+	expectOmahaError(t, postUpdate("<request>"+strings.Repeat(" ", 2048)+"</request>"), http.StatusRequestEntityTooLarge, "error-requestTooLarge")
+
+	updateLimiter = newRateLimiter(1, 1)
+	updateLimiter.allow("192.0.2.1", time.Now())
+
+	w := postUpdate("<request protocol=\"3.0\"></request>")
+	expectOmahaError(t, w, http.StatusTooManyRequests, "error-rateLimited")
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+func TestFileHandler(t *testing.T) {
+	defer func(dir string, oldDB userDB) { opts.LocalStorageDir, db = dir, oldDB }(opts.LocalStorageDir, db)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+
+	opts.LocalStorageDir, err = ioutil.TempDir("", "comaha-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(opts.LocalStorageDir)
+
+	err = ioutil.WriteFile(path.Join(opts.LocalStorageDir, "abcDEF"), []byte("payload"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// present on disk, but not a known payload
+	err = ioutil.WriteFile(path.Join(opts.LocalStorageDir, "stray"), []byte("stray"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddPayload("abcDEF", "sha1", "sha256", 7, payloadVersion{build: 800, timestamp: time.Unix(0, 0).UTC()})
+
+	get := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		fileHandler(w, httptest.NewRequest("GET", "/file?id="+id, nil), nil)
+		return w
+	}
+
+	if w := get("abcDEF"); w.Code != http.StatusOK || w.Body.String() != "payload" {
+		t.Errorf("Expected the payload, got %v '%v'", w.Code, w.Body.String())
+	}
+	if w := get("stray"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected files unknown to the database to be refused, got %v", w.Code)
+	}
+	for _, id := range []string{"", "..%2Fusers.sqlite", "abc.DEF", "%2Fetc%2Fpasswd"} {
+		if w := get(id); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected ID '%v' to be rejected, got %v", id, w.Code)
+		}
+	}
+}
+
+func TestFileHandlerStorageDir(t *testing.T) {
+	defer func(dir string, oldDB userDB) { opts.LocalStorageDir, db = dir, oldDB }(opts.LocalStorageDir, db)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+
+	// anything but the default 'storage'
+	opts.LocalStorageDir, err = ioutil.TempDir("", "comaha-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(opts.LocalStorageDir)
+
+	err = ioutil.WriteFile(path.Join(opts.LocalStorageDir, "xyzUVW"), []byte("payload"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddPayload("xyzUVW", "sha1", "sha256", 7, payloadVersion{build: 800, timestamp: time.Unix(0, 0).UTC()})
+
+	w := httptest.NewRecorder()
+	fileHandler(w, httptest.NewRequest("GET", "/file?id=xyzUVW", nil), nil)
+	if w.Code != http.StatusOK || w.Body.String() != "payload" {
+		t.Errorf("Expected the payload from '%v', got %v '%v'", opts.LocalStorageDir, w.Code, w.Body.String())
+	}
+}
+
+func TestDeleteDelta(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+
+	target := s.addPayload("800.0.0", "stable", []byte("full image"))
+	deltaID := s.addDelta("766.4.0", target, []byte("delta from 766.4.0"))
+
+	// a payload is not a delta, and its file stays
+	resp, err := http.Get(s.URL + "/admin/delete_delta?id=" + target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a payload, got %v", resp.StatusCode)
+	}
+	update, err := s.machine("700.0.0", "stable").Update()
+	if err != nil || update == nil || update.ID != target {
+		t.Errorf("Expected the payload to remain installable, got %+v, %v", update, err)
+	}
+
+	resp, err = http.Get(s.URL + "/admin/delete_delta?id=" + deltaID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the delta to be deleted, got %v", resp.StatusCode)
+	}
+	if _, err := os.Stat(path.Join(opts.LocalStorageDir, deltaID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the delta's file to be removed, got %v", err)
+	}
+}
+
+func TestUploadBodyLimits(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+	target := s.addPayload("800.0.0", "stable", []byte("full image"))
+	opts.MaxPayloadSize = 4
+
+	post := func(endpoint string, body io.Reader) int {
+		params := url.Values{"version": {"900.0.0"}, "channel": {"stable"}, "source_version": {"800.0.0"}, "target": {target}, "sha1": {"x"}, "sha256": {"y"}}
+		resp, err := http.Post(s.URL+endpoint+"?"+params.Encode(), "application/octet-stream", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, endpoint := range []string{"/admin/add_payload", "/admin/add_delta"} {
+		// a reader of unknown length is sent chunked, without a Content-Length
+		if code := post(endpoint, ioutil.NopCloser(strings.NewReader("abc"))); code != http.StatusLengthRequired {
+			t.Errorf("%v: expected 411 for a chunked upload, got %v", endpoint, code)
+		}
+		if code := post(endpoint, strings.NewReader("abcde")); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%v: expected 413 for an upload over the limit, got %v", endpoint, code)
+		}
+	}
+}
+
+// a database which cannot mark payloads as required stops
+type failingRequiredStopDB struct {
+	userDB
+}
+
+func (f failingRequiredStopDB) SetPayloadRequiredStop(id string, value bool) error {
+	return errors.New("disk I/O error")
+}
+
+func TestAddPayloadConstraintFailure(t *testing.T) {
+	_, cleanup := newConformanceServer(t)
+	defer cleanup()
+	realDB := db
+	db = failingRequiredStopDB{realDB}
+	defer func() { db = realDB }()
+
+	data := []byte("required stop 800.0.0")
+	sha1, sha256 := payloadHashes(data)
+	version, _ := parseVersionString("800.0.0")
+	_, err := addPayload(data, sha1, sha256, version, "stable", nil, true)
+	if err == nil {
+		t.Fatal("Expected the failure to be reported")
+	}
+
+	if images, _ := db.ListImages("stable"); len(images) != 0 {
+		t.Errorf("Expected the payload not to be offered without its constraints, got %+v", images)
+	}
+	if ids, _ := db.ListFileIDs(); len(ids) != 0 {
+		t.Errorf("Expected no payload in the database, got %v", ids)
+	}
+	if files, _ := ioutil.ReadDir(opts.LocalStorageDir); len(files) != 0 {
+		t.Errorf("Expected the stored file to be removed, got %v", files)
+	}
+}
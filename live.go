@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// kinds of live stream messages which are not sent to webhooks
+const (
+	liveUpdateCheck = "update_check"
+	liveEvent       = "event"
+)
+
+const (
+	liveSubscriberBuffer = 100
+	liveKeepalive        = 30 * time.Second
+)
+
+// Fans messages out to all connected live stream clients. Slow clients
+// miss messages rather than holding up the update server.
+type liveHub struct {
+	mutex       sync.Mutex
+	subscribers map[chan webhookMessage]struct{}
+	closed      bool
+}
+
+var hub = &liveHub{subscribers: make(map[chan webhookMessage]struct{})}
+
+func (h *liveHub) subscribe() chan webhookMessage {
+	ch := make(chan webhookMessage, liveSubscriberBuffer)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subscribers[ch] = struct{}{}
+
+	return ch
+}
+
+func (h *liveHub) unsubscribe(ch chan webhookMessage) {
+	h.mutex.Lock()
+	delete(h.subscribers, ch)
+	h.mutex.Unlock()
+}
+
+// end all live streams, so that they do not hold up a shutdown
+func (h *liveHub) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.closed = true
+	for ch := range h.subscribers {
+		close(ch)
+		delete(h.subscribers, ch)
+	}
+}
+
+// send a message to all live stream clients; never blocks
+func broadcast(kind string, data interface{}) {
+	msg := webhookMessage{Kind: kind, Timestamp: time.Now().UTC(), Data: data}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for ch := range hub.subscribers {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// stream update checks, events and admin actions as server-sent events
+func streamHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := hub.subscribe()
+	defer hub.unsubscribe(ch)
+
+	keepalive := time.NewTicker(liveKeepalive)
+	defer keepalive.Stop()
+
+	// end the stream before the server's write timeout cuts the connection;
+	// browsers reconnect on their own
+	var end <-chan time.Time
+	if opts.WriteTimeout > 0 {
+		lifetime := opts.WriteTimeout - liveKeepalive
+		if lifetime <= 0 {
+			lifetime = opts.WriteTimeout / 2
+		}
+		timer := time.NewTimer(lifetime)
+		defer timer.Stop()
+		end = timer.C
+	}
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Errorf("streamHandler: encoding '%v' message: %v", msg.Kind, err.Error())
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", msg.Kind, data)
+			if err != nil {
+				return
+			}
+		case <-keepalive.C:
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		case <-end:
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveStream(t *testing.T) {
+	defer func(old time.Duration) { opts.WriteTimeout = old }(opts.WriteTimeout)
+	opts.WriteTimeout = 0
+
+	router := httprouter.New()
+	router.GET("/admin/stream", streamHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/admin/stream")
+	if err != nil {
+		t.Fatalf("GET: %v", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected content type 'text/event-stream', got '%v'", ct)
+	}
+
+	// wait for the handler to subscribe
+	for i := 0; i < 100; i++ {
+		hub.mutex.Lock()
+		n := len(hub.subscribers)
+		hub.mutex.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	broadcast(liveUpdateCheck, ClientRequest{MachineID: "foo"})
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %v", err.Error())
+	}
+	if line != "event: update_check\n" {
+		t.Errorf("Unexpected line '%v'", line)
+	}
+
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %v", err.Error())
+	}
+	if !strings.HasPrefix(line, "data: ") || !strings.Contains(line, `"MachineID":"foo"`) {
+		t.Errorf("Unexpected line '%v'", line)
+	}
+}
+
+func TestLiveStreamEndsBeforeWriteTimeout(t *testing.T) {
+	defer func(old time.Duration) { opts.WriteTimeout = old }(opts.WriteTimeout)
+	opts.WriteTimeout = 100 * time.Millisecond
+
+	router := httprouter.New()
+	router.GET("/admin/stream", streamHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/admin/stream")
+	if err != nil {
+		t.Fatalf("GET: %v", err.Error())
+	}
+	defer resp.Body.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the stream to end cleanly, got %v", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stream to end")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"sync"
 	"time"
 )
 
@@ -20,19 +21,97 @@ var db userDB
 var fileBE fileBackend
 
 var opts struct {
-	ListenAddr        string `short:"l" long:"listenaddr" default:"0.0.0.0" description:"address to listen on"`
-	Port              int    `short:"P" long:"port" default:"8080" description:"port to listen on"`
-	DisableTimestamps bool   `short:"t" long:"disabletimestamps" description:"disable timestamps in logs (useful when using journald)"`
-	Debug             bool   `short:"d" long:"debug" description:"run in debug mode"`
-	Backend           string `long:"file-backend" description:"type of file backend" default:"local"`
+	Config string `short:"c" long:"config" env:"COMAHA_CONFIG" description:"YAML configuration file; environment variables and flags take precedence over it"`
+
+	ListenAddr        string        `short:"l" long:"listenaddr" env:"COMAHA_LISTENADDR" default:"0.0.0.0" description:"address to listen on"`
+	Port              int           `short:"P" long:"port" env:"COMAHA_PORT" default:"8080" description:"port to listen on"`
+	TLSCert           string        `long:"tls-cert" env:"COMAHA_TLS_CERT" description:"certificate file; enables HTTPS together with --tls-key"`
+	TLSKey            string        `long:"tls-key" env:"COMAHA_TLS_KEY" description:"private key file for --tls-cert"`
+	TLSReloadInterval time.Duration `long:"tls-reload-interval" env:"COMAHA_TLS_RELOAD_INTERVAL" description:"how often to check the certificate files for changes (they are also reloaded on SIGHUP)" default:"1m"`
+	TLSClientCA       string        `long:"tls-client-ca" env:"COMAHA_TLS_CLIENT_CA" description:"CA bundle; client certificates signed by it grant access to the admin API and the panel"`
+	HTTPRedirectPort  int           `long:"http-redirect-port" env:"COMAHA_HTTP_REDIRECT_PORT" description:"also listen for plain HTTP on this port and redirect it to HTTPS (0 disables)" default:"0"`
+	DisableTimestamps bool          `short:"t" long:"disabletimestamps" env:"COMAHA_DISABLETIMESTAMPS" description:"disable timestamps in logs (useful when using journald)"`
+	Debug             bool          `short:"d" long:"debug" env:"COMAHA_DEBUG" description:"run in debug mode"`
+	DBDriver          string        `long:"db-driver" env:"COMAHA_DB_DRIVER" default:"sqlite3" description:"database driver (only sqlite3 is supported)"`
+	DBDSN             string        `long:"db-dsn" env:"COMAHA_DB_DSN" default:"users.sqlite" description:"database to open, e.g. the path of the sqlite file"`
+	Backend           string        `long:"file-backend" env:"COMAHA_FILE_BACKEND" description:"type of file backend" default:"local"`
+	LocalStorageDir   string        `long:"local-storage-dir" env:"COMAHA_LOCAL_STORAGE_DIR" description:"directory the local file backend keeps payloads in" default:"storage"`
+	StaticDir         string        `long:"static-dir" env:"COMAHA_STATIC_DIR" description:"directory containing the panel templates" default:"static"`
+	RequestLogSize    int           `long:"request-log-size" env:"COMAHA_REQUEST_LOG_SIZE" description:"number of client requests kept in the database" default:"100000"`
+
+	EventMaxAge            time.Duration `long:"event-max-age" env:"COMAHA_EVENT_MAX_AGE" description:"roll events older than this up into daily aggregates (0 keeps them forever)" default:"0"`
+	EventMaxCount          int           `long:"event-max-count" env:"COMAHA_EVENT_MAX_COUNT" description:"roll all but this many newest events up into daily aggregates (0 keeps all)" default:"0"`
+	EventRetentionInterval time.Duration `long:"event-retention-interval" env:"COMAHA_EVENT_RETENTION_INTERVAL" description:"how often to enforce event retention" default:"1h"`
+	EventQueueSize         int           `long:"event-queue-size" env:"COMAHA_EVENT_QUEUE_SIZE" description:"number of reported events buffered for writing; when full, events are written while the client waits" default:"10000"`
+	EventBatchSize         int           `long:"event-batch-size" env:"COMAHA_EVENT_BATCH_SIZE" description:"maximum number of events written in one transaction" default:"500"`
+	EventFlushInterval     time.Duration `long:"event-flush-interval" env:"COMAHA_EVENT_FLUSH_INTERVAL" description:"maximum time a reported event waits to be written" default:"200ms"`
+
+	Webhooks       []string      `long:"webhook" env:"COMAHA_WEBHOOKS" env-delim:"," description:"URL to POST notifications to (may be given multiple times)"`
+	WebhookRetries int           `long:"webhook-retries" env:"COMAHA_WEBHOOK_RETRIES" description:"number of times a failed webhook delivery is retried" default:"5"`
+	WebhookBackoff time.Duration `long:"webhook-backoff" env:"COMAHA_WEBHOOK_BACKOFF" description:"delay before the first webhook retry, doubled after each attempt" default:"1s"`
+
+	ReadHeaderTimeout time.Duration `long:"read-header-timeout" env:"COMAHA_READ_HEADER_TIMEOUT" description:"maximum time to receive a request's headers" default:"10s"`
+	ReadTimeout       time.Duration `long:"read-timeout" env:"COMAHA_READ_TIMEOUT" description:"maximum time to receive a whole request, including payload uploads" default:"15m"`
+	WriteTimeout      time.Duration `long:"write-timeout" env:"COMAHA_WRITE_TIMEOUT" description:"maximum time to send a response, including payload downloads" default:"1h"`
+	IdleTimeout       time.Duration `long:"idle-timeout" env:"COMAHA_IDLE_TIMEOUT" description:"how long idle keep-alive connections are kept open" default:"2m"`
+
+	MaxUpdateRequestSize int64   `long:"max-update-request-size" env:"COMAHA_MAX_UPDATE_REQUEST_SIZE" description:"maximum size of an update request in bytes" default:"262144"`
+	MaxPayloadSize       int64   `long:"max-payload-size" env:"COMAHA_MAX_PAYLOAD_SIZE" description:"maximum size of an uploaded payload or delta in bytes" default:"1073741824"`
+	UpdateRateLimit      float64 `long:"update-rate-limit" env:"COMAHA_UPDATE_RATE_LIMIT" description:"update requests per second allowed per client address (0 disables the limit)" default:"0"`
+	UpdateRateBurst      int     `long:"update-rate-burst" env:"COMAHA_UPDATE_RATE_BURST" description:"update requests a client may make at once before --update-rate-limit applies" default:"20"`
+
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" env:"COMAHA_SHUTDOWN_TIMEOUT" description:"how long to wait for running requests, e.g. payload transfers, when shutting down" default:"30s"`
+
+	TrustedProxies []string `long:"trusted-proxy" env:"COMAHA_TRUSTED_PROXIES" env-delim:"," description:"address or CIDR of a reverse proxy whose forwarding headers are believed (may be given multiple times)"`
+	PublicURL      string   `long:"public-url" env:"COMAHA_PUBLIC_URL" description:"base URL clients reach the server under, used for download URLs instead of the request's Host"`
+
+	MirrorSyncInterval   time.Duration `long:"mirror-sync-interval" env:"COMAHA_MIRROR_SYNC_INTERVAL" description:"how often payloads are replicated to the mirrors from the configuration file and their health is checked" default:"5m"`
+	UpstreamSyncInterval time.Duration `long:"upstream-sync-interval" env:"COMAHA_UPSTREAM_SYNC_INTERVAL" description:"how often the upstream servers from the configuration file are checked for new releases" default:"1h"`
+	FetchTimeout         time.Duration `long:"fetch-timeout" env:"COMAHA_FETCH_TIMEOUT" description:"maximum time to download a payload added by URL" default:"1h"`
+	FetchMaxSize         int64         `long:"fetch-max-size" env:"COMAHA_FETCH_MAX_SIZE" description:"maximum size of a payload added by URL in bytes" default:"1073741824"`
+
+	UploadDir     string        `long:"upload-dir" env:"COMAHA_UPLOAD_DIR" description:"directory partial chunked uploads are kept in" default:"uploads"`
+	UploadTimeout time.Duration `long:"upload-timeout" env:"COMAHA_UPLOAD_TIMEOUT" description:"how long a chunked upload may receive no data before it is abandoned" default:"24h"`
+
+	AdminToken string `long:"admin-token" env:"COMAHA_ADMIN_TOKEN" description:"token required for the admin API and the panel"`
 }
 
 func main() {
-	_, err := flags.Parse(&opts)
+	parser := flags.NewParser(&opts, flags.Default)
+
+	sections := &fileConfig{}
+	if filename := configFileName(os.Args[1:]); filename != "" {
+		var err error
+		sections, err = loadConfigFile(parser, filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not load configuration: %v\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	_, err := parser.Parse()
 	if err != nil {
 		os.Exit(1)
 	}
 
+	err = setApps(sections.Apps)
+	if err == nil {
+		err = validateConfig()
+	}
+	if err == nil {
+		err = setMirrors(sections.Mirrors)
+	}
+	if err == nil {
+		err = setUpstreams(sections.Upstreams)
+	}
+	if err == nil {
+		trustedProxies, err = parseTrustedProxies(opts.TrustedProxies)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err.Error())
+		os.Exit(1)
+	}
+
 	log.SetFormatter(&log.TextFormatter{DisableTimestamp: opts.DisableTimestamps})
 	if opts.Debug {
 		log.SetLevel(log.DebugLevel)
@@ -45,7 +124,7 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	// open db
-	db, err = newSqliteDB("users.sqlite")
+	db, err = newSqliteDB(opts.DBDSN)
 	if err != nil {
 		log.Errorf("Could not open database: %v", err.Error())
 		os.Exit(1)
@@ -54,29 +133,171 @@ func main() {
 
 	switch opts.Backend {
 	case "local":
-		cwd, err := os.Getwd()
-		if err != nil {
-			log.Errorf("Could not cwd: %v", err.Error())
+		storageDir := opts.LocalStorageDir
+		if !path.IsAbs(storageDir) {
+			cwd, err := os.Getwd()
+			if err != nil {
+				log.Errorf("Could not cwd: %v", err.Error())
+			}
+			storageDir = path.Join(cwd, storageDir)
 		}
-		fileBE = local.New(path.Join(cwd, "storage"))
+		fileBE = local.New(storageDir)
 	default:
 		log.Fatalf("Unknown file backend '%v'", opts.Backend)
 	}
 
+	uploads, err = newUploadStore(opts.UploadDir, opts.UploadTimeout)
+	if err != nil {
+		log.Errorf("Could not create the upload directory: %v", err.Error())
+		os.Exit(1)
+	}
+
+	if opts.UpdateRateLimit > 0 {
+		updateLimiter = newRateLimiter(opts.UpdateRateLimit, opts.UpdateRateBurst)
+	}
+
+	notifier = newWebhookNotifier(opts.Webhooks, opts.WebhookRetries, opts.WebhookBackoff)
+	eventLog = newEventWriter(db, opts.EventQueueSize, opts.EventBatchSize, opts.EventFlushInterval)
+	fetcher = newPayloadFetcher(opts.FetchTimeout, opts.FetchMaxSize)
+
+	// closed on shutdown to end the background goroutines
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runEventRetention(opts.EventMaxAge, opts.EventMaxCount, opts.EventRetentionInterval, stop)
+	}()
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runMirrorSync(opts.MirrorSyncInterval, stop)
+	}()
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runUpstreamSync(opts.UpstreamSyncInterval, stop)
+	}()
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runUploadCleanup(stop)
+	}()
+
+	router := newRouter()
+
+	listenString := fmt.Sprintf("%v:%v", opts.ListenAddr, opts.Port)
+	server := newHTTPServer(listenString, router)
+	servers := []*http.Server{server}
+	serveErrors := make(chan error, 2)
+
+	if opts.TLSCert != "" {
+		reloader, err := newCertReloader(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			log.Fatalf("Could not load TLS certificate: %v", err.Error())
+		}
+		go reloader.watch(opts.TLSReloadInterval, stop)
+
+		server.TLSConfig, err = newTLSConfig(reloader)
+		if err != nil {
+			log.Fatalf("Could not set up TLS: %v", err.Error())
+		}
+
+		if opts.HTTPRedirectPort != 0 {
+			redirectString := fmt.Sprintf("%v:%v", opts.ListenAddr, opts.HTTPRedirectPort)
+			redirectServer := newHTTPServer(redirectString, http.HandlerFunc(httpsRedirectHandler))
+			servers = append(servers, redirectServer)
+
+			go func() {
+				err := redirectServer.ListenAndServe()
+				if err != http.ErrServerClosed {
+					serveErrors <- err
+				}
+			}()
+		}
+
+		go func() {
+			err := server.ListenAndServeTLS("", "")
+			if err != http.ErrServerClosed {
+				serveErrors <- err
+			}
+		}()
+	} else {
+		go func() {
+			err := server.ListenAndServe()
+			if err != http.ErrServerClosed {
+				serveErrors <- err
+			}
+		}()
+	}
+
+	serveErr := waitForShutdownSignal(serveErrors)
+	shutdown(servers, stop, &background, opts.ShutdownTimeout)
+
+	if serveErr != nil {
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+func newRouter() *httprouter.Router {
 	router := httprouter.New()
 
+	router.GET("/healthz", healthzHandler)
+	router.GET("/readyz", readyzHandler)
 	router.GET("/file", fileHandler)
 	router.POST("/update", updateHandler)
 	//http.HandleFunc("/admin/add_group", addGroupHandler)
-	router.POST("/admin/add_payload", addPayloadHandler)
-	router.POST("/admin/attach_payload_to_channel", attachPayloadToChannelHandler)
-	router.GET("/admin/delete_payload", deletePayloadHandler)
-	router.GET("/admin/channel/:channel/force_downgrade", channelForceDowngradeGetHandler)
-	router.POST("/admin/channel/:channel/force_downgrade", channelForceDowngradePostHandler)
-	router.GET("/panel", panelHandler)
+	router.POST("/admin/add_payload", requireAdmin(addPayloadHandler))
+	router.POST("/admin/uploads", requireAdmin(createUploadHandler))
+	router.GET("/admin/uploads", requireAdmin(uploadsHandler))
+	router.GET("/admin/uploads/:id", requireAdmin(uploadHandler))
+	router.PUT("/admin/uploads/:id", requireAdmin(uploadChunkHandler))
+	router.DELETE("/admin/uploads/:id", requireAdmin(deleteUploadHandler))
+	router.POST("/admin/uploads/:id/finalize", requireAdmin(finalizeUploadHandler))
+	router.POST("/admin/add_payload_from_url", requireAdmin(addPayloadFromURLHandler))
+	router.GET("/admin/fetch_jobs", requireAdmin(fetchJobsHandler))
+	router.GET("/admin/fetch_jobs/:id", requireAdmin(fetchJobHandler))
+	router.POST("/admin/add_delta", requireAdmin(addDeltaHandler))
+	router.GET("/admin/delete_delta", requireAdmin(deleteDeltaHandler))
+	router.POST("/admin/attach_payload_to_channel", requireAdmin(attachPayloadToChannelHandler))
+	router.GET("/admin/delete_payload", requireAdmin(deletePayloadHandler))
+	router.POST("/admin/yank_payload", requireAdmin(yankPayloadHandler))
+	router.POST("/admin/unyank_payload", requireAdmin(unyankPayloadHandler))
+	router.GET("/admin/channel/:channel/force_downgrade", requireAdmin(channelForceDowngradeGetHandler))
+	router.POST("/admin/channel/:channel/force_downgrade", requireAdmin(channelForceDowngradePostHandler))
+	router.POST("/admin/payload/:id/min_source_version", requireAdmin(payloadMinSourceVersionPostHandler))
+	router.POST("/admin/payload/:id/required_stop", requireAdmin(payloadRequiredStopPostHandler))
+	router.GET("/admin/channels", requireAdmin(channelsHandler))
+	router.GET("/admin/channel/:channel/images", requireAdmin(channelImagesHandler))
+	router.GET("/admin/events", requireAdmin(eventsHandler))
+	router.GET("/admin/stream", requireAdmin(streamHandler))
+	router.GET("/admin/event_aggregates", requireAdmin(eventAggregatesHandler))
+	router.GET("/admin/release_stats", requireAdmin(releaseStatsHandler))
+	router.GET("/admin/machines", requireAdmin(machinesHandler))
+	router.GET("/admin/machine/:machine/requests", requireAdmin(machineRequestsHandler))
+	router.GET("/admin/webhook_dead_letters", requireAdmin(webhookDeadLettersHandler))
+	router.GET("/admin/event_queue", requireAdmin(eventQueueHandler))
+	router.GET("/admin/mirrors", requireAdmin(mirrorsHandler))
+	router.GET("/admin/upstreams", requireAdmin(upstreamsHandler))
+	router.GET("/panel", requireAdmin(panelHandler))
 	//http.HandleFunc("/admin/add_user", addUserHandler)
 	router.GET("/", homeHandler)
 
-	listenString := fmt.Sprintf("%v:%v", opts.ListenAddr, opts.Port)
-	http.ListenAndServe(listenString, router)
+	return router
+}
+
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+	}
 }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kdomanski/comaha/file-backends/local"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a mirror as given in the 'mirrors' section of the configuration file
+type mirrorConfig struct {
+	Name string `yaml:"name"`
+	// base URL under which the files in Dir are served, e.g. by a CDN
+	URL string `yaml:"url"`
+	Dir string `yaml:"dir"`
+	// clients from these networks are offered this mirror first
+	Networks []string `yaml:"networks"`
+}
+
+// where a mirror's files are kept; satisfied by the local file backend
+type mirrorStore interface {
+	Put(id string, data []byte) error
+	Get(id string) ([]byte, error)
+	Delete(id string) error
+	List() ([]string, error)
+	Check() error
+}
+
+// Name of the file in which a mirror records the payloads comaha wrote to
+// it. Mirrors may share their directory with other files, so only these
+// are ever removed. The leading dot keeps it apart from payload IDs.
+const mirrorManifest = ".comaha-manifest.json"
+
+// A location, besides this server, which clients can download payloads
+// from. Payloads are replicated to it by runMirrorSync; it is only
+// advertised for the files it holds and only while it is healthy.
+type mirror struct {
+	name     string
+	url      string
+	networks []*net.IPNet
+	store    mirrorStore
+
+	mutex     sync.RWMutex
+	healthy   bool
+	files     map[string]bool
+	lastSync  time.Time
+	lastError string
+}
+
+// state of a mirror as reported by the admin API
+type mirrorStatus struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Networks  []string  `json:"networks"`
+	Healthy   bool      `json:"healthy"`
+	Files     int       `json:"files"`
+	LastSync  time.Time `json:"lastSync"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// configured mirrors, in the order of the configuration file
+var mirrors []*mirror
+
+// wakes runMirrorSync up before its interval has passed
+var mirrorSyncRequests = make(chan struct{}, 1)
+
+func newMirror(name, baseURL string, networks []*net.IPNet, store mirrorStore) *mirror {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	return &mirror{
+		name:     name,
+		url:      baseURL,
+		networks: networks,
+		store:    store,
+		files:    make(map[string]bool),
+	}
+}
+
+// set up the mirrors from the configuration file
+func setMirrors(configured []mirrorConfig) error {
+	known := make(map[string]bool)
+	var result []*mirror
+
+	for _, c := range configured {
+		if c.Name == "" {
+			return errors.New("a mirror is missing its 'name'")
+		}
+		if known[c.Name] {
+			return fmt.Errorf("mirror '%v' is configured more than once", c.Name)
+		}
+		known[c.Name] = true
+
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+			return fmt.Errorf("mirror '%v': invalid URL '%v'", c.Name, c.URL)
+		}
+
+		info, err := os.Stat(c.Dir)
+		if err != nil {
+			return fmt.Errorf("mirror '%v': %v", c.Name, err.Error())
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("mirror '%v': '%v' is not a directory", c.Name, c.Dir)
+		}
+		// the stored payloads would be taken for replicated ones
+		if filepath.Clean(c.Dir) == filepath.Clean(opts.LocalStorageDir) {
+			return fmt.Errorf("mirror '%v': the directory must not be the local storage directory", c.Name)
+		}
+
+		networks, err := parseNetworks(c.Networks)
+		if err != nil {
+			return fmt.Errorf("mirror '%v': %v", c.Name, err.Error())
+		}
+
+		result = append(result, newMirror(c.Name, c.URL, networks, local.New(c.Dir)))
+	}
+
+	mirrors = result
+	return nil
+}
+
+func (m *mirror) serves(ip net.IP) bool {
+	for _, network := range m.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mirror) has(id string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.healthy && m.files[id]
+}
+
+// Codebases of the locations the client at 'client' can download file 'id'
+// from, best first: the mirrors for the client's network, the mirrors for
+// every network, this server and finally the mirrors for other networks.
+func downloadURLs(client net.IP, localURL, id string) []string {
+	var preferred, general, others []string
+
+	for _, m := range mirrors {
+		if !m.has(id) {
+			continue
+		}
+
+		switch {
+		case len(m.networks) == 0:
+			general = append(general, m.url)
+		case client != nil && m.serves(client):
+			preferred = append(preferred, m.url)
+		default:
+			others = append(others, m.url)
+		}
+	}
+
+	urls := append(preferred, general...)
+	urls = append(urls, fileBE.GetUpdateURL(localURL))
+	return append(urls, others...)
+}
+
+// ask runMirrorSync to replicate a change to the stored files soon
+func requestMirrorSync() {
+	select {
+	case mirrorSyncRequests <- struct{}{}:
+	default:
+	}
+}
+
+// periodically, and whenever requested, bring all mirrors up to date with
+// the database until 'stop' is closed
+func runMirrorSync(interval time.Duration, stop <-chan struct{}) {
+	if len(mirrors) == 0 {
+		return
+	}
+
+	for {
+		for _, m := range mirrors {
+			m.sync(stop)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-mirrorSyncRequests:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Check that the mirror works, copy the files it lacks and remove the ones
+// it received from comaha which are no longer in the database.
+func (m *mirror) sync(stop <-chan struct{}) {
+	err := m.store.Check()
+	if err != nil {
+		m.failed(fmt.Errorf("checking storage: %v", err.Error()))
+		return
+	}
+
+	written, err := m.loadManifest()
+	if err != nil {
+		m.failed(fmt.Errorf("reading %v: %v", mirrorManifest, err.Error()))
+		return
+	}
+
+	ids, err := db.ListFileIDs()
+	if err != nil {
+		m.failed(fmt.Errorf("listing files: %v", err.Error()))
+		return
+	}
+	stored, err := m.store.List()
+	if err != nil {
+		m.failed(fmt.Errorf("listing stored files: %v", err.Error()))
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	present := make(map[string]bool)
+	for _, id := range stored {
+		if wanted[id] {
+			present[id] = true
+		}
+	}
+
+	m.mutex.Lock()
+	m.healthy = true
+	m.files = present
+	m.mutex.Unlock()
+
+	var syncErr error
+	copied, removed := 0, 0
+
+	for _, id := range ids {
+		if present[id] {
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		// recorded first, so that an interrupted copy is cleaned up later
+		if !written[id] {
+			written[id] = true
+			err = m.saveManifest(written)
+			if err != nil {
+				log.Errorf("Mirror '%v': recording file '%v': %v", m.name, id, err.Error())
+				syncErr = fmt.Errorf("writing %v: %v", mirrorManifest, err.Error())
+				delete(written, id)
+				continue
+			}
+		}
+
+		err = m.copy(id)
+		if err != nil {
+			log.Errorf("Mirror '%v': copying file '%v': %v", m.name, id, err.Error())
+			syncErr = fmt.Errorf("copying file '%v': %v", id, err.Error())
+			continue
+		}
+		copied++
+
+		m.mutex.Lock()
+		m.files[id] = true
+		m.mutex.Unlock()
+	}
+
+	for id := range written {
+		if wanted[id] {
+			continue
+		}
+
+		// also removes what an interrupted copy left behind
+		err = m.store.Delete(id)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Mirror '%v': removing file '%v': %v", m.name, id, err.Error())
+			syncErr = fmt.Errorf("removing file '%v': %v", id, err.Error())
+			continue
+		}
+		delete(written, id)
+		removed++
+	}
+	if removed > 0 {
+		err = m.saveManifest(written)
+		if err != nil {
+			log.Errorf("Mirror '%v': writing %v: %v", m.name, mirrorManifest, err.Error())
+			syncErr = fmt.Errorf("writing %v: %v", mirrorManifest, err.Error())
+		}
+	}
+
+	if copied > 0 || removed > 0 {
+		log.Infof("Mirror '%v': copied %v and removed %v files", m.name, copied, removed)
+	}
+
+	m.mutex.Lock()
+	m.lastSync = time.Now().UTC()
+	m.lastError = ""
+	if syncErr != nil {
+		m.lastError = syncErr.Error()
+	}
+	m.mutex.Unlock()
+}
+
+// IDs of the files comaha wrote to the mirror
+func (m *mirror) loadManifest() (map[string]bool, error) {
+	written := make(map[string]bool)
+
+	data, err := m.store.Get(mirrorManifest)
+	if os.IsNotExist(err) {
+		return written, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	err = json.Unmarshal(data, &ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		written[id] = true
+	}
+	return written, nil
+}
+
+func (m *mirror) saveManifest(written map[string]bool) error {
+	ids := []string{}
+	for id := range written {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return m.store.Put(mirrorManifest, data)
+}
+
+func (m *mirror) copy(id string) error {
+	data, err := ioutil.ReadFile(path.Join(opts.LocalStorageDir, id))
+	if err != nil {
+		return err
+	}
+
+	return m.store.Put(id, data)
+}
+
+// stop advertising the mirror until a sync succeeds
+func (m *mirror) failed(err error) {
+	log.Errorf("Mirror '%v' is unhealthy: %v", m.name, err.Error())
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.healthy = false
+	m.lastSync = time.Now().UTC()
+	m.lastError = err.Error()
+}
+
+func (m *mirror) status() mirrorStatus {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	networks := []string{}
+	for _, network := range m.networks {
+		networks = append(networks, network.String())
+	}
+
+	return mirrorStatus{
+		Name:      m.name,
+		URL:       m.url,
+		Networks:  networks,
+		Healthy:   m.healthy,
+		Files:     len(m.files),
+		LastSync:  m.lastSync,
+		LastError: m.lastError,
+	}
+}
+
+func mirrorsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	statuses := []mirrorStatus{}
+	for _, m := range mirrors {
+		statuses = append(statuses, m.status())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(statuses)
+	if err != nil {
+		log.Errorf("mirrorsHandler: encoding response: %v", err.Error())
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/kdomanski/comaha/file-backends/local"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func newTestMirror(t *testing.T, name string, store mirrorStore, networks ...string) *mirror {
+	parsed, err := parseNetworks(networks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newMirror(name, "http://"+name+".example.com/files", parsed, store)
+}
+
+func TestDownloadURLs(t *testing.T) {
+	defer func(old []*mirror) { mirrors = old }(mirrors)
+	defer func(old fileBackend) { fileBE = old }(fileBE)
+	fileBE = local.New("")
+
+	eu := newTestMirror(t, "eu", nil, "10.1.0.0/16")
+	us := newTestMirror(t, "us", nil, "10.2.0.0/16")
+	cdn := newTestMirror(t, "cdn", nil)
+	broken := newTestMirror(t, "broken", nil)
+	mirrors = []*mirror{eu, us, cdn, broken}
+
+	for _, m := range mirrors {
+		m.healthy = true
+		m.files["payload"] = true
+	}
+	broken.healthy = false
+	delete(us.files, "payload")
+	us.files["other"] = true
+
+	tests := []struct {
+		client   string
+		id       string
+		expected []string
+	}{
+		{"10.1.2.3", "payload", []string{"http://eu.example.com/files/", "http://cdn.example.com/files/", "http://comaha/file?id="}},
+		{"10.2.2.3", "payload", []string{"http://cdn.example.com/files/", "http://comaha/file?id=", "http://eu.example.com/files/"}},
+		{"10.2.2.3", "other", []string{"http://us.example.com/files/", "http://comaha/file?id="}},
+		{"", "payload", []string{"http://cdn.example.com/files/", "http://comaha/file?id=", "http://eu.example.com/files/"}},
+		{"10.1.2.3", "missing", []string{"http://comaha/file?id="}},
+	}
+
+	for _, test := range tests {
+		urls := downloadURLs(net.ParseIP(test.client), "http://comaha", test.id)
+		if !reflect.DeepEqual(urls, test.expected) {
+			t.Errorf("Client '%v', file '%v': expected %v, got %v", test.client, test.id, test.expected, urls)
+		}
+	}
+}
+
+func TestMirrorSync(t *testing.T) {
+	defer func(old userDB) { db = old }(db)
+	defer func(old string) { opts.LocalStorageDir = old }(opts.LocalStorageDir)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+
+	opts.LocalStorageDir, err = ioutil.TempDir("", "comaha-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(opts.LocalStorageDir)
+
+	mirrorDir, err := ioutil.TempDir("", "comaha-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mirrorDir)
+
+	for _, id := range []string{"kept", "added"} {
+		err = ioutil.WriteFile(path.Join(opts.LocalStorageDir, id), []byte("contents of "+id), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.AddPayload(id, "sha1", "sha256", 12, payloadVersion{build: 800})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a payload already replicated and files not written by comaha, one
+	// of them named like a payload
+	for _, name := range []string{"kept", "index", "index.html"} {
+		err = ioutil.WriteFile(path.Join(mirrorDir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := newTestMirror(t, "eu", local.New(mirrorDir))
+	m.sync(make(chan struct{}))
+
+	status := m.status()
+	if !status.Healthy || status.Files != 2 || status.LastError != "" {
+		t.Errorf("Expected a healthy mirror with 2 files, got %+v", status)
+	}
+	if !m.has("kept") || !m.has("added") || m.has("index") {
+		t.Errorf("Unexpected files on the mirror: %v", m.files)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(mirrorDir, "added"))
+	if err != nil || string(data) != "contents of added" {
+		t.Errorf("Expected the missing payload to be copied, got '%s' (%v)", data, err)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(mirrorDir, "kept")); string(data) != "kept" {
+		t.Errorf("Expected the replicated payload to be left alone, got '%s'", data)
+	}
+
+	// only the files comaha wrote are removed once they are deleted, with
+	// what an interrupted copy left of them
+	err = ioutil.WriteFile(path.Join(mirrorDir, ".added.tmp"), []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"kept", "added"} {
+		err = db.DeletePayload(id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.sync(make(chan struct{}))
+
+	for _, name := range []string{"added", ".added.tmp"} {
+		if _, err := os.Stat(path.Join(mirrorDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected '%v' to be removed from the mirror", name)
+		}
+	}
+	for _, name := range []string{"kept", "index", "index.html"} {
+		if _, err := os.Stat(path.Join(mirrorDir, name)); err != nil {
+			t.Errorf("Expected files not written by comaha to be left alone: %v", err)
+		}
+	}
+	if status := m.status(); status.Files != 0 || status.LastError != "" {
+		t.Errorf("Expected a mirror without files, got %+v", status)
+	}
+
+	// a mirror whose storage fails is no longer advertised
+	os.RemoveAll(mirrorDir)
+	m.sync(make(chan struct{}))
+
+	status = m.status()
+	if status.Healthy || status.LastError == "" {
+		t.Errorf("Expected an unhealthy mirror, got %+v", status)
+	}
+	if m.has("kept") {
+		t.Error("Expected the files of an unhealthy mirror not to be advertised")
+	}
+}
+
+func TestSetMirrors(t *testing.T) {
+	defer func(old []*mirror) { mirrors = old }(mirrors)
+
+	dir, err := ioutil.TempDir("", "comaha-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := [][]mirrorConfig{
+		{{URL: "http://a.example.com/", Dir: dir}},
+		{{Name: "a", URL: "ftp://a.example.com/", Dir: dir}},
+		{{Name: "a", URL: "http://a.example.com/", Dir: path.Join(dir, "missing")}},
+		{{Name: "a", URL: "http://a.example.com/", Dir: dir, Networks: []string{"10.0.0.0/33"}}},
+		{{Name: "a", URL: "http://a.example.com/", Dir: dir}, {Name: "a", URL: "http://b.example.com/", Dir: dir}},
+	}
+	for _, configured := range invalid {
+		if err := setMirrors(configured); err == nil {
+			t.Errorf("Expected an error for %+v", configured)
+		}
+	}
+
+	err = setMirrors([]mirrorConfig{{Name: "a", URL: "http://a.example.com/comaha", Dir: dir, Networks: []string{"10.0.0.0/8", "192.168.1.1"}}})
+	if err != nil {
+		t.Fatalf("setMirrors: %v", err.Error())
+	}
+	if len(mirrors) != 1 || mirrors[0].url != "http://a.example.com/comaha/" || len(mirrors[0].networks) != 2 {
+		t.Errorf("Unexpected mirrors %+v", mirrors)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// networks of reverse proxies whose Forwarded, X-Forwarded-For and
+// X-Forwarded-Proto headers are believed, set from --trusted-proxy
+var trustedProxies []*net.IPNet
+
+func parseTrustedProxies(specs []string) ([]*net.IPNet, error) {
+	networks, err := parseNetworks(specs)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %v", err.Error())
+	}
+	return networks, nil
+}
+
+// accepts both CIDRs and single addresses
+func parseNetworks(specs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address or network '%v'", spec)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or network '%v'", spec)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// one step of a proxy chain: the address a proxy received the request from
+// and the scheme it was received with, if reported
+type forwardedHop struct {
+	addr  string
+	proto string
+}
+
+// strip quotes, IPv6 brackets and the port from a forwarded address
+func cleanForwardedAddr(s string) string {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+}
+
+// only schemes which are safe to put into download URLs
+func cleanForwardedProto(s string) string {
+	s = strings.ToLower(strings.Trim(strings.TrimSpace(s), `"`))
+	if s == "http" || s == "https" {
+		return s
+	}
+	return ""
+}
+
+// the proxy chain from the client to the nearest proxy, as described by the
+// Forwarded header or, if it is missing, by X-Forwarded-For and X-Forwarded-Proto
+func forwardedHops(header http.Header) []forwardedHop {
+	var hops []forwardedHop
+
+	if values := header["Forwarded"]; len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			var hop forwardedHop
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+
+				switch strings.ToLower(strings.TrimSpace(kv[0])) {
+				case "for":
+					hop.addr = cleanForwardedAddr(kv[1])
+				case "proto":
+					hop.proto = cleanForwardedProto(kv[1])
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+
+	var protos []string
+	if values := header["X-Forwarded-Proto"]; len(values) > 0 {
+		protos = strings.Split(strings.Join(values, ","), ",")
+	}
+
+	if values := header["X-Forwarded-For"]; len(values) > 0 {
+		for _, addr := range strings.Split(strings.Join(values, ","), ",") {
+			hops = append(hops, forwardedHop{addr: cleanForwardedAddr(addr)})
+		}
+	}
+
+	// proxies usually set a single X-Forwarded-Proto, describing the
+	// request they received, so the schemes are aligned from the right
+	for i := 1; i <= len(protos) && i <= len(hops); i++ {
+		hops[len(hops)-i].proto = cleanForwardedProto(protos[len(protos)-i])
+	}
+	if len(hops) == 0 && len(protos) > 0 {
+		hops = append(hops, forwardedHop{proto: cleanForwardedProto(protos[len(protos)-1])})
+	}
+
+	return hops
+}
+
+// Address and scheme of the client which made the request. Forwarding headers
+// are only honoured when the request comes from a trusted proxy; the chain is
+// then followed towards the client as long as it passes through trusted proxies.
+func resolveClient(r *http.Request) (string, string) {
+	addr := cleanForwardedAddr(r.RemoteAddr)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if !isTrustedProxy(addr) {
+		return addr, scheme
+	}
+
+	hops := forwardedHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].proto != "" {
+			scheme = hops[i].proto
+		}
+		if hops[i].addr == "" {
+			break
+		}
+
+		addr = hops[i].addr
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+
+	return addr, scheme
+}
+
+// address of the client which made the request, see resolveClient
+func clientIP(r *http.Request) string {
+	addr, _ := resolveClient(r)
+	return addr
+}
+
+// base URL under which clients reach this server
+func publicBaseURL(r *http.Request) string {
+	if opts.PublicURL != "" {
+		return strings.TrimRight(opts.PublicURL, "/")
+	}
+
+	_, scheme := resolveClient(r)
+	return fmt.Sprintf("%v://%v", scheme, r.Host)
+}
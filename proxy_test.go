@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClient(t *testing.T) {
+	defer func(old []*net.IPNet) { trustedProxies = old }(trustedProxies)
+
+	var err error
+	trustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err.Error())
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		headers    map[string]string
+		addr       string
+		scheme     string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "203.0.113.7:4711",
+			addr:       "203.0.113.7",
+			scheme:     "http",
+		},
+		{
+			name:       "direct TLS client",
+			remoteAddr: "203.0.113.7:4711",
+			tls:        true,
+			addr:       "203.0.113.7",
+			scheme:     "https",
+		},
+		{
+			name:       "untrusted client spoofing headers",
+			remoteAddr: "203.0.113.7:4711",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https"},
+			addr:       "203.0.113.7",
+			scheme:     "http",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.1.2.3:4711",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https"},
+			addr:       "198.51.100.1",
+			scheme:     "https",
+		},
+		{
+			name:       "client spoofing behind a trusted proxy",
+			remoteAddr: "10.1.2.3:4711",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.99, 198.51.100.1"},
+			addr:       "198.51.100.1",
+			scheme:     "http",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.1.2.3:4711",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, 10.9.9.9"},
+			addr:       "198.51.100.1",
+			scheme:     "http",
+		},
+		{
+			name:       "trusted IPv6 proxy",
+			remoteAddr: "[2001:db8::1]:4711",
+			headers:    map[string]string{"X-Forwarded-For": "2001:db8::42"},
+			addr:       "2001:db8::42",
+			scheme:     "http",
+		},
+		{
+			name:       "invalid scheme",
+			remoteAddr: "10.1.2.3:4711",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "javascript"},
+			addr:       "198.51.100.1",
+			scheme:     "http",
+		},
+		{
+			name:       "scheme only",
+			remoteAddr: "10.1.2.3:4711",
+			headers:    map[string]string{"X-Forwarded-Proto": "https"},
+			addr:       "10.1.2.3",
+			scheme:     "https",
+		},
+		{
+			name:       "Forwarded header",
+			remoteAddr: "10.1.2.3:4711",
+			headers: map[string]string{
+				"Forwarded":       `for="[2001:db8:cafe::17]:4711";proto=https, for=10.9.9.9;proto=http`,
+				"X-Forwarded-For": "192.0.2.99",
+			},
+			addr:   "2001:db8:cafe::17",
+			scheme: "https",
+		},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/update", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+
+		addr, scheme := resolveClient(r)
+		if addr != test.addr || scheme != test.scheme {
+			t.Errorf("%v: expected '%v' via %v, got '%v' via %v", test.name, test.addr, test.scheme, addr, scheme)
+		}
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	for _, spec := range []string{"10.0.0.0/33", "example.com", ""} {
+		_, err := parseTrustedProxies([]string{spec})
+		if err == nil {
+			t.Errorf("Expected '%v' to be rejected", spec)
+		}
+	}
+}
+
+func TestPublicBaseURL(t *testing.T) {
+	defer func(old string) { opts.PublicURL = old }(opts.PublicURL)
+
+	r := httptest.NewRequest("POST", "http://10.0.0.5:8080/update", nil)
+
+	opts.PublicURL = ""
+	if u := publicBaseURL(r); u != "http://10.0.0.5:8080" {
+		t.Errorf("Expected the Host-derived URL, got '%v'", u)
+	}
+
+	opts.PublicURL = "https://updates.example.com/"
+	if u := publicBaseURL(r); u != "https://updates.example.com" {
+		t.Errorf("Expected the public URL, got '%v'", u)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Unix(1000, 0)
+
+	// the burst is available at once
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("Request %v within the burst was refused", i+1)
+		}
+	}
+
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatal("Request beyond the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %v", wait)
+	}
+
+	// other clients are not affected
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("Another client was refused")
+	}
+
+	// tokens refill at the given rate
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("Request after refilling was refused")
+	}
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); ok {
+		t.Error("Only one token should have been refilled")
+	}
+
+	// refilled buckets are dropped
+	l.allow("c", now.Add(time.Hour))
+	if n := len(l.buckets); n != 1 {
+		t.Errorf("Expected only the new client's bucket to remain, got %v", n)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// periodically roll old events up into daily aggregates until 'stop' is closed
+func runEventRetention(maxAge time.Duration, maxCount int, interval time.Duration, stop <-chan struct{}) {
+	if maxAge <= 0 && maxCount <= 0 {
+		log.Info("Event retention disabled")
+		return
+	}
+
+	for {
+		deleted, err := db.CompactEvents(maxAge, maxCount)
+		if err != nil {
+			log.Errorf("Event retention: %v", err.Error())
+		} else if deleted > 0 {
+			log.Infof("Event retention: compacted %v events", deleted)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// block until SIGINT or SIGTERM arrives or a server fails, in which case its
+// error is returned; a second signal terminates the process immediately
+func waitForShutdownSignal(serveErrors <-chan error) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		log.Infof("Received %v, shutting down", sig)
+		return nil
+	case err := <-serveErrors:
+		log.Errorf("Server stopped: %v", err.Error())
+		return err
+	}
+}
+
+// Stop accepting connections and wait up to 'timeout' for the running
+// requests, e.g. payload uploads and downloads, to finish. Then, within the
+// same timeout, wait for the background work started with 'stop' and
+// 'background' to end while aborting payload downloads, writing the queued
+// events and delivering the queued webhook messages.
+func shutdown(servers []*http.Server, stop chan struct{}, background *sync.WaitGroup, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	close(stop)
+
+	// live streams never finish on their own
+	hub.close()
+
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Warnf("Shutdown: interrupting remaining requests: %v", err.Error())
+			server.Close()
+		}
+	}
+
+	// the queued events and webhook messages are flushed right away rather
+	// than after the background work, which may outlast the timeout
+	downloads, events, webhooks := fetcher, eventLog, notifier
+	var finished sync.WaitGroup
+	finished.Add(2)
+	go func() {
+		defer finished.Done()
+		background.Wait()
+	}()
+	go func() {
+		defer finished.Done()
+		if downloads != nil {
+			downloads.Close()
+		}
+		if events != nil {
+			events.Close()
+		}
+		if webhooks != nil {
+			webhooks.Close()
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		finished.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info("Shutdown complete")
+	case <-ctx.Done():
+		log.Warn("Shutdown: timed out waiting for background work, event writes and webhook deliveries")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	defer func(oldHub *liveHub, oldNotifier *webhookNotifier) { hub, notifier = oldHub, oldNotifier }(hub, notifier)
+	hub = &liveHub{subscribers: make(map[chan webhookMessage]struct{})}
+	notifier = nil
+
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+
+	stream := hub.subscribe()
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	backgroundStopped := false
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		<-stop
+		backgroundStopped = true
+	}()
+
+	shutdown([]*http.Server{server}, stop, &background, 5*time.Second)
+
+	r := <-results
+	if r.err != nil || r.body != "done" {
+		t.Errorf("Expected the running request to complete, got '%v' (%v)", r.body, r.err)
+	}
+
+	if _, ok := <-stream; ok {
+		t.Error("Expected live streams to be ended")
+	}
+
+	if !backgroundStopped {
+		t.Error("Expected shutdown to wait for the background work")
+	}
+
+	_, err = http.Get("http://" + listener.Addr().String() + "/")
+	if err == nil {
+		t.Error("Expected new connections to be refused after shutdown")
+	}
+}
+
+func TestShutdownWritesQueuedEvents(t *testing.T) {
+	defer func(oldHub *liveHub, oldNotifier *webhookNotifier, oldEventLog *eventWriter) {
+		hub, notifier, eventLog = oldHub, oldNotifier, oldEventLog
+	}(hub, notifier, eventLog)
+	hub = &liveHub{subscribers: make(map[chan webhookMessage]struct{})}
+	notifier = nil
+
+	f := &fakeEventDB{}
+	eventLog = newEventWriter(f, 100, 100, time.Hour)
+	for i := 0; i < 5; i++ {
+		logEvent(Event{MachineID: "machine"})
+	}
+
+	var background sync.WaitGroup
+	shutdown(nil, make(chan struct{}), &background, 5*time.Second)
+
+	if len(f.written) != 5 {
+		t.Errorf("Expected the 5 queued events to be written, got %v", len(f.written))
+	}
+}
+
+func TestShutdownWritesEventsDespiteBackgroundWork(t *testing.T) {
+	defer func(oldHub *liveHub, oldNotifier *webhookNotifier, oldEventLog *eventWriter) {
+		hub, notifier, eventLog = oldHub, oldNotifier, oldEventLog
+	}(hub, notifier, eventLog)
+	hub = &liveHub{subscribers: make(map[chan webhookMessage]struct{})}
+	notifier = nil
+
+	f := &fakeEventDB{}
+	eventLog = newEventWriter(f, 100, 100, time.Hour)
+	for i := 0; i < 5; i++ {
+		logEvent(Event{MachineID: "machine"})
+	}
+
+	// background work ignoring 'stop' until after the timeout
+	release := make(chan struct{})
+	defer close(release)
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		<-release
+	}()
+
+	shutdown(nil, make(chan struct{}), &background, 100*time.Millisecond)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.written) != 5 {
+		t.Errorf("Expected the 5 queued events to be written, got %v", len(f.written))
+	}
+}
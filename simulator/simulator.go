@@ -0,0 +1,365 @@
+// Package simulator imitates CoreOS machines running update_engine, for
+// testing comaha and measuring its performance.
+package simulator
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-omaha/omaha"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CoreOSAppID = "{e96281a6-d1af-4bde-9a0a-97b76e56dc57}"
+
+// event types and results as sent by update_engine
+const (
+	EventTypeDownload = 13
+	EventTypeArrive   = 14
+	EventTypeApply    = 3
+	EventTypeSuccess  = 800
+
+	EventResultError = 0
+	EventResultOK    = 1
+	EventResultDone  = 2
+)
+
+const updaterVersion = "CoreOSUpdateEngine-0.1.0.0"
+
+// returned for responses with a status other than 200
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %v: %v", e.Code, strings.TrimSpace(e.Body))
+}
+
+// an update offered by the server
+type Update struct {
+	ID      string
+	Version string
+	// download locations in the order the server prefers them
+	URLs    []string
+	SHA1    string
+	SHA256  string
+	Size    int64
+	IsDelta bool
+}
+
+// A simulated machine. Its fields describe the installed system and may be
+// changed between requests.
+type Machine struct {
+	// base URL of the update server, e.g. http://localhost:8080
+	Server string
+	// full URL of the update endpoint, if it is not Server + "/update"
+	UpdateURL string
+	Client    *http.Client
+
+	AppID      string
+	MachineID  string
+	BootID     string
+	Version    string
+	Track      string
+	OEM        string
+	OEMVersion string
+
+	// version before the last reboot into an update, reported once afterwards
+	PreviousVersion string
+}
+
+// a machine with random machine and boot IDs running CoreOS 'version'
+func NewMachine(server, version, track string) *Machine {
+	return &Machine{
+		Server:    strings.TrimRight(server, "/"),
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		AppID:     CoreOSAppID,
+		MachineID: randomHex(16),
+		BootID:    "{" + randomUUID() + "}",
+		Version:   version,
+		Track:     track,
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randomUUID() string {
+	h := randomHex(16)
+	return fmt.Sprintf("%v-%v-%v-%v-%v", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+// the request skeleton update_engine sends, with the machine's single app
+func (m *Machine) NewRequest() (*omaha.Request, *omaha.App) {
+	req := omaha.NewRequest("Chateau", "CoreOS", m.Version+"_x86_64", "")
+	req.Version = updaterVersion
+	req.UpdaterVersion = updaterVersion
+	req.InstallSource = "scheduler"
+	req.IsMachine = "1"
+
+	app := req.AddApp(m.AppID, m.Version)
+	app.MachineID = m.MachineID
+	app.BootId = m.BootID
+	app.Track = m.Track
+	app.OEM = m.OEM
+	app.OEMVersion = m.OEMVersion
+	app.Lang = "en-US"
+
+	return req, app
+}
+
+// post a request to the server's update endpoint
+func (m *Machine) Send(req *omaha.Request) (*omaha.Response, error) {
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := m.UpdateURL
+	if endpoint == "" {
+		endpoint = m.Server + "/update"
+	}
+
+	httpResp, err := m.Client.Post(endpoint, "text/xml", bytes.NewReader(append([]byte(xml.Header), body...)))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Code: httpResp.StatusCode, Body: string(data)}
+	}
+
+	var resp omaha.Response
+	err = xml.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("parsing response: %v", err)
+	}
+
+	return &resp, nil
+}
+
+// the response for the machine's app
+func (m *Machine) sendApp(req *omaha.Request) (*omaha.App, error) {
+	resp, err := m.Send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range resp.Apps {
+		if app.Id == m.AppID {
+			if app.Status != "ok" {
+				return app, fmt.Errorf("app status '%v'", app.Status)
+			}
+			return app, nil
+		}
+	}
+
+	return nil, errors.New("response contains no app")
+}
+
+// Check for an update like update_engine does periodically, together with a
+// ping. Returns nil if the machine is up to date.
+func (m *Machine) CheckForUpdate() (*Update, error) {
+	req, app := m.NewRequest()
+	app.AddPing()
+	app.AddUpdateCheck()
+
+	respApp, err := m.sendApp(req)
+	if err != nil {
+		return nil, err
+	}
+
+	uc := respApp.UpdateCheck
+	if uc == nil {
+		return nil, errors.New("response contains no updatecheck")
+	}
+
+	switch uc.Status {
+	case "noupdate":
+		return nil, nil
+	case "ok":
+	default:
+		return nil, fmt.Errorf("updatecheck status '%v'", uc.Status)
+	}
+
+	if uc.Urls == nil || len(uc.Urls.Urls) == 0 || uc.Manifest == nil || len(uc.Manifest.Packages.Packages) == 0 {
+		return nil, errors.New("update without URL or package")
+	}
+
+	pkg := uc.Manifest.Packages.Packages[0]
+	size, err := strconv.ParseInt(pkg.Size, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid package size '%v'", pkg.Size)
+	}
+
+	update := &Update{
+		ID:      pkg.Name,
+		Version: uc.Manifest.Version,
+		SHA1:    pkg.Hash,
+		Size:    size,
+	}
+	for _, u := range uc.Urls.Urls {
+		update.URLs = append(update.URLs, u.CodeBase+pkg.Name)
+	}
+	for _, action := range uc.Manifest.Actions.Actions {
+		if action.Event == "postinstall" {
+			update.SHA256 = action.Sha256
+			update.IsDelta = action.IsDelta
+		}
+	}
+
+	return update, nil
+}
+
+// Send a ping without an update check. update_engine reports the previous
+// version this way after rebooting into an update.
+func (m *Machine) Ping() error {
+	req, app := m.NewRequest()
+	app.AddPing()
+
+	respApp, err := m.sendApp(req)
+	if err != nil {
+		return err
+	}
+	if respApp.Ping == nil || respApp.Ping.Status != "ok" {
+		return errors.New("ping was not acknowledged")
+	}
+
+	return nil
+}
+
+// report an event; a zero errorCode is omitted
+func (m *Machine) ReportEvent(evType, evResult, errorCode int) error {
+	req, app := m.NewRequest()
+	event := app.AddEvent()
+	event.Type = strconv.Itoa(evType)
+	event.Result = strconv.Itoa(evResult)
+	event.PreviousVersion = m.PreviousVersion
+	if errorCode != 0 {
+		event.ErrorCode = strconv.Itoa(errorCode)
+	}
+
+	_, err := m.sendApp(req)
+	return err
+}
+
+// download an update from the first of its URLs which works and verify its
+// size and hashes; the error of the last URL is returned if none does
+func (m *Machine) Download(update *Update) ([]byte, error) {
+	if len(update.URLs) == 0 {
+		return nil, errors.New("update without URL")
+	}
+
+	// like update_engine, fall back to the next URL when a download fails
+	var err error
+	for _, u := range update.URLs {
+		var data []byte
+		data, err = m.downloadFrom(u, update)
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func (m *Machine) downloadFrom(url string, update *Update) ([]byte, error) {
+	resp, err := m.Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &StatusError{Code: resp.StatusCode, Body: string(data)}
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) != update.Size {
+		return nil, fmt.Errorf("downloaded %v bytes, expected %v", len(data), update.Size)
+	}
+
+	rawSha1 := sha1.Sum(data)
+	if h := base64.StdEncoding.EncodeToString(rawSha1[:]); h != update.SHA1 {
+		return nil, fmt.Errorf("SHA1 mismatch: '%v' != '%v'", h, update.SHA1)
+	}
+	rawSha256 := sha256.Sum256(data)
+	if h := base64.StdEncoding.EncodeToString(rawSha256[:]); update.SHA256 != "" && h != update.SHA256 {
+		return nil, fmt.Errorf("SHA256 mismatch: '%v' != '%v'", h, update.SHA256)
+	}
+
+	return data, nil
+}
+
+// boot into 'version' with a new boot ID
+func (m *Machine) Reboot(version string) {
+	m.PreviousVersion = m.Version
+	m.Version = version
+	m.BootID = "{" + randomUUID() + "}"
+}
+
+// Go through a whole update like update_engine: check, download, apply,
+// reboot and report success. Returns the installed update, nil if the machine
+// was up to date.
+func (m *Machine) Update() (*Update, error) {
+	update, err := m.CheckForUpdate()
+	if err != nil || update == nil {
+		return nil, err
+	}
+
+	err = m.ReportEvent(EventTypeDownload, EventResultOK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = m.Download(update)
+	if err != nil {
+		m.ReportEvent(EventTypeApply, EventResultError, 1)
+		return nil, err
+	}
+
+	err = m.ReportEvent(EventTypeArrive, EventResultOK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.ReportEvent(EventTypeApply, EventResultOK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Reboot(update.Version)
+
+	err = m.ReportEvent(EventTypeApply, EventResultDone, 0)
+	if err != nil {
+		return nil, err
+	}
+	m.PreviousVersion = ""
+
+	return update, nil
+}
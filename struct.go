@@ -6,6 +6,26 @@ type payload struct {
 	SHA1    string
 	SHA256  string
 	Size    int64
+
+	// upgrade path constraints, see nextPayloadInChain
+	MinSourceVersion string
+	RequiredStop     bool
+
+	// yanked payloads are listed but never offered in their channel
+	Yanked        bool
+	YankReason    string
+	YankDowngrade bool
+}
+
+// an incremental payload, applicable only on top of SourceVersion,
+// which upgrades the machine to the version of the Target payload
+type delta struct {
+	ID            string
+	SourceVersion string
+	Target        string
+	SHA1          string
+	SHA256        string
+	Size          int64
 }
 
 type fileBackend interface {
@@ -13,4 +33,7 @@ type fileBackend interface {
 	Store(data []byte) (string, error)
 	Delete(id string) error
 	GetUpdateURL(localURL string) string
+
+	// verify that files can be stored, read back and deleted
+	Check() error
 }
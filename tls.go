@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Serves the certificate and key from disk, reloading them on SIGHUP or when
+// either file changes. A failed reload keeps the previous certificate.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// latest modification time of the certificate and key files
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, filename := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mutex.Unlock()
+
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.cert, nil
+}
+
+// reload on SIGHUP and whenever the files' modification time changes,
+// until 'stop' is closed
+func (c *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			log.Info("TLS: reloading certificate on SIGHUP")
+		case <-ticker.C:
+			modTime, err := c.filesModTime()
+			if err != nil {
+				log.Warnf("TLS: checking certificate files: %v", err.Error())
+				continue
+			}
+
+			c.mutex.RLock()
+			changed := !modTime.Equal(c.modTime)
+			c.mutex.RUnlock()
+
+			if !changed {
+				continue
+			}
+			log.Info("TLS: certificate files changed, reloading")
+		}
+
+		err := c.reload()
+		if err != nil {
+			log.Errorf("TLS: reloading certificate, keeping the previous one: %v", err.Error())
+		}
+	}
+}
+
+func loadClientCAs(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in '%v'", filename)
+	}
+
+	return pool, nil
+}
+
+// TLS settings of the server; client certificates are requested but only
+// required by the admin routes, see requireAdmin
+func newTLSConfig(reloader *certReloader) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if opts.TLSClientCA != "" {
+		pool, err := loadClientCAs(opts.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// whether the request came with a client certificate signed by --tls-client-ca
+func hasVerifiedClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// redirect plain HTTP requests to the HTTPS listener
+func httpsRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if host == "" {
+		http.Error(w, "Missing Host header", http.StatusBadRequest)
+		return
+	}
+
+	target := "https://" + host
+	if opts.Port != 443 {
+		target = fmt.Sprintf("https://%v", net.JoinHostPort(host, fmt.Sprint(opts.Port)))
+	}
+	target += r.URL.RequestURI()
+
+	// 308 keeps the method, so that POSTs to /update survive the redirect
+	http.Redirect(w, r, target, http.StatusPermanentRedirect)
+}
+
+func validateTLSConfig() error {
+	if opts.TLSCert == "" {
+		if opts.TLSClientCA != "" || opts.HTTPRedirectPort != 0 {
+			return errors.New("'tls-client-ca' and 'http-redirect-port' require 'tls-cert'")
+		}
+		return nil
+	}
+
+	if opts.TLSReloadInterval <= 0 {
+		return errors.New("'tls-reload-interval' must be positive")
+	}
+	if opts.HTTPRedirectPort < 0 || opts.HTTPRedirectPort > 65535 || opts.HTTPRedirectPort == opts.Port {
+		return fmt.Errorf("invalid HTTP redirect port %v", opts.HTTPRedirectPort)
+	}
+	if opts.TLSClientCA != "" {
+		_, err := loadClientCAs(opts.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("loading TLS client CA: %v", err.Error())
+		}
+	}
+
+	return nil
+}
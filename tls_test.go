@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// write a self-signed certificate for 'name' and its key into 'dir'
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := path.Join(dir, "tls.crt")
+	keyFile := path.Join(dir, "tls.key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func servedCommonName(t *testing.T, c *certReloader) string {
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err.Error())
+	}
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comaha-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "old.example.com")
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err.Error())
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go reloader.watch(10*time.Millisecond, stop)
+
+	if name := servedCommonName(t, reloader); name != "old.example.com" {
+		t.Fatalf("Expected the initial certificate, got '%v'", name)
+	}
+
+	// make sure the modification time differs on coarse filesystems
+	time.Sleep(20 * time.Millisecond)
+	writeTestCert(t, dir, "new.example.com")
+	future := time.Now().Add(time.Second)
+	os.Chtimes(certFile, future, future)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for servedCommonName(t, reloader) != "new.example.com" {
+		if time.Now().After(deadline) {
+			t.Fatal("The changed certificate was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a broken certificate keeps the previous one in place
+	err = ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloader.reload() == nil {
+		t.Error("Expected reloading a broken certificate to fail")
+	}
+	if name := servedCommonName(t, reloader); name != "new.example.com" {
+		t.Errorf("Expected the previous certificate after a failed reload, got '%v'", name)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	defer func(old int) { opts.Port = old }(opts.Port)
+
+	for port, expected := range map[int]string{
+		443:  "https://updates.example.com/update?x=1",
+		8443: "https://updates.example.com:8443/update?x=1",
+	} {
+		opts.Port = port
+
+		r := httptest.NewRequest("POST", "http://updates.example.com:8080/update?x=1", nil)
+		w := httptest.NewRecorder()
+		httpsRedirectHandler(w, r)
+
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("Expected status 308, got %v", w.Code)
+		}
+		if location := w.Header().Get("Location"); location != expected {
+			t.Errorf("Expected redirect to '%v', got '%v'", expected, location)
+		}
+	}
+}
+
+func TestRequireAdminClientCert(t *testing.T) {
+	defer func(token, ca string) { opts.AdminToken, opts.TLSClientCA = token, ca }(opts.AdminToken, opts.TLSClientCA)
+	opts.AdminToken = "secret"
+	opts.TLSClientCA = "ca.pem"
+
+	handler := requireAdmin(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {})
+
+	request := func(verified bool, token string) int {
+		r := httptest.NewRequest("GET", "https://localhost/admin/channels", nil)
+		if verified {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+		return w.Code
+	}
+
+	if code := request(true, ""); code != http.StatusOK {
+		t.Errorf("Expected a verified client certificate to be accepted, got %v", code)
+	}
+	if code := request(false, "secret"); code != http.StatusOK {
+		t.Errorf("Expected the token to be accepted, got %v", code)
+	}
+	if code := request(false, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected an anonymous request to be rejected, got %v", code)
+	}
+}
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	flags "github.com/jessevdk/go-flags"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var globalOpts struct {
+	Server string `short:"s" long:"server" env:"COMAHA_SERVER" default:"http://127.0.0.1:8080" description:"base URL of the comaha server"`
+	Token  string `short:"T" long:"token" env:"COMAHA_TOKEN" description:"admin token"`
+	JSON   bool   `short:"j" long:"json" description:"print raw JSON instead of tables"`
+}
+
+func main() {
+	parser := flags.NewParser(&globalOpts, flags.Default)
+
+	parser.AddCommand("hash", "Compute payload hashes", "Print the base64-encoded SHA1 and SHA256 of a file, as expected by the server.", &hashCommand{})
+	parser.AddCommand("upload", "Upload a payload", "Upload a payload to a channel, verifying its hashes on the server.", &uploadCommand{})
+	parser.AddCommand("fetch", "Add a payload from a URL", "Have the server download a payload from a URL, verify its hashes and add it to a channel.", &fetchCommand{})
+	parser.AddCommand("fetch-jobs", "List payload downloads", "List the downloads started with 'fetch' and their progress.", &fetchJobsCommand{})
+	parser.AddCommand("upload-delta", "Upload a delta payload", "Upload a delta payload applicable on top of a given version.", &uploadDeltaCommand{})
+	parser.AddCommand("channels", "List channels", "List all channels.", &channelsCommand{})
+	parser.AddCommand("images", "List payloads in a channel", "List all payloads in a channel.", &imagesCommand{})
+	parser.AddCommand("attach", "Attach a payload to a channel", "Add an existing payload to another channel.", &attachCommand{})
+	parser.AddCommand("detach", "Detach a payload from a channel", "Remove a payload from a channel. The payload is deleted once it is in no channel.", &detachCommand{})
+	parser.AddCommand("delete", "Delete a payload", "Remove a payload from all channels and delete it.", &deleteCommand{})
+	parser.AddCommand("yank", "Yank a payload", "Stop offering a payload in a channel without deleting it.", &yankCommand{})
+	parser.AddCommand("unyank", "Restore a yanked payload", "Offer a previously yanked payload in a channel again.", &unyankCommand{})
+	parser.AddCommand("force-downgrade", "Show or set forced downgrades", "Show or set (on/off) forced downgrades for a channel.", &forceDowngradeCommand{})
+	parser.AddCommand("events", "Query the event log", "List events reported by machines, newest first.", &eventsCommand{})
+	parser.AddCommand("machines", "List machines", "List all machines which contacted the server.", &machinesCommand{})
+	parser.AddCommand("machine", "Show a machine's requests", "Show the most recent requests of a machine.", &machineCommand{})
+	parser.AddCommand("release-stats", "Show per-release statistics", "Show update success and failure counts per payload and channel.", &releaseStatsCommand{})
+
+	_, err := parser.Parse()
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		// go-flags already printed its own errors
+		if _, ok := err.(*flags.Error); !ok {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// perform an admin API request and return the response body
+func request(method, path string, query url.Values, body io.Reader, size int64) ([]byte, error) {
+	u := strings.TrimRight(globalOpts.Server, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if globalOpts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+globalOpts.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return data, nil
+}
+
+// fetch JSON from the server and either print it as-is or decode it into 'out'
+func getJSON(path string, query url.Values, out interface{}) (bool, error) {
+	data, err := request("GET", path, query, nil, 0)
+	if err != nil {
+		return false, err
+	}
+
+	if globalOpts.JSON {
+		var pretty bytes.Buffer
+		err = json.Indent(&pretty, data, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(pretty.String())
+		return true, nil
+	}
+
+	return false, json.Unmarshal(data, out)
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func boolFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+type fileHashes struct {
+	SHA1   string
+	SHA256 string
+	Size   int64
+}
+
+func hashFile(filename string) (fileHashes, error) {
+	var result fileHashes
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+
+	h1 := sha1.New()
+	h256 := sha256.New()
+	result.Size, err = io.Copy(io.MultiWriter(h1, h256), file)
+	if err != nil {
+		return result, err
+	}
+
+	result.SHA1 = base64.StdEncoding.EncodeToString(h1.Sum(nil))
+	result.SHA256 = base64.StdEncoding.EncodeToString(h256.Sum(nil))
+
+	return result, nil
+}
+
+// upload a file to an admin endpoint together with its hashes
+func uploadFile(path, filename string, query url.Values) error {
+	hashes, err := hashFile(filename)
+	if err != nil {
+		return err
+	}
+
+	query.Set("sha1", hashes.SHA1)
+	query.Set("sha256", hashes.SHA256)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = request("POST", path, query, file, hashes.Size)
+	return err
+}
+
+type hashCommand struct {
+	Args struct {
+		File string `positional-arg-name:"FILE"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *hashCommand) Execute(args []string) error {
+	hashes, err := hashFile(c.Args.File)
+	if err != nil {
+		return err
+	}
+
+	if globalOpts.JSON {
+		return json.NewEncoder(os.Stdout).Encode(hashes)
+	}
+
+	fmt.Printf("sha1:   %v\nsha256: %v\nsize:   %v\n", hashes.SHA1, hashes.SHA256, hashes.Size)
+	return nil
+}
+
+type uploadCommand struct {
+	Version          string `short:"v" long:"version" required:"yes" description:"version of the payload"`
+	Channel          string `short:"c" long:"channel" required:"yes" description:"channel to add the payload to"`
+	MinSourceVersion string `long:"min-source-version" description:"oldest version the payload can be installed from"`
+	RequiredStop     bool   `long:"required-stop" description:"machines below this version must install it before any newer one"`
+	ChunkSize        int64  `long:"chunk-size" description:"upload in chunks of this many bytes, resuming after errors (0 sends the file at once)" default:"0"`
+	Retries          int    `long:"retries" description:"number of times a failed chunk is retried" default:"5"`
+	Args             struct {
+		File string `positional-arg-name:"FILE"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *uploadCommand) Execute(args []string) error {
+	query := url.Values{}
+	query.Set("version", c.Version)
+	query.Set("channel", c.Channel)
+	if c.MinSourceVersion != "" {
+		query.Set("min_source_version", c.MinSourceVersion)
+	}
+	if c.RequiredStop {
+		query.Set("required_stop", "1")
+	}
+
+	if c.ChunkSize > 0 {
+		return uploadChunked(c.Args.File, query, c.ChunkSize, c.Retries)
+	}
+	return uploadFile("/admin/add_payload", c.Args.File, query)
+}
+
+// progress of an upload session
+type uploadSession struct {
+	ID       string `json:"id"`
+	Size     int64  `json:"size"`
+	Received int64  `json:"received"`
+}
+
+// upload a payload through an upload session, continuing from the
+// server's progress when a chunk fails
+func uploadChunked(filename string, query url.Values, chunkSize int64, retries int) error {
+	hashes, err := hashFile(filename)
+	if err != nil {
+		return err
+	}
+
+	query.Set("sha1", hashes.SHA1)
+	query.Set("sha256", hashes.SHA256)
+	query.Set("size", fmt.Sprint(hashes.Size))
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := request("POST", "/admin/uploads", query, nil, 0)
+	if err != nil {
+		return err
+	}
+	var session uploadSession
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return err
+	}
+	sessionPath := "/admin/uploads/" + session.ID
+
+	failures := 0
+	for session.Received < session.Size {
+		fmt.Fprintf(os.Stderr, "\r%v/%v bytes   ", session.Received, session.Size)
+
+		size := chunkSize
+		if remaining := session.Size - session.Received; remaining < size {
+			size = remaining
+		}
+		chunk := io.NewSectionReader(file, session.Received, size)
+		offset := url.Values{"offset": {fmt.Sprint(session.Received)}}
+
+		data, err = request("PUT", sessionPath, offset, chunk, size)
+		if err == nil {
+			err = json.Unmarshal(data, &session)
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		if failures > retries {
+			return fmt.Errorf("upload %v failed: %v", session.ID, err.Error())
+		}
+		fmt.Fprintf(os.Stderr, "\nChunk failed, resuming: %v\n", err.Error())
+		time.Sleep(time.Duration(failures) * time.Second)
+
+		// continue from what the server actually received
+		data, err = request("GET", sessionPath, nil, nil, 0)
+		if err == nil {
+			err = json.Unmarshal(data, &session)
+		}
+		if err != nil {
+			return fmt.Errorf("upload %v failed: %v", session.ID, err.Error())
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\r%v/%v bytes\n", session.Received, session.Size)
+
+	_, err = request("POST", sessionPath+"/finalize", nil, nil, 0)
+	return err
+}
+
+// a download started by the server, see fetchCommand
+type fetchJob struct {
+	ID        int    `json:"id"`
+	URL       string `json:"url"`
+	Version   string `json:"version"`
+	Channel   string `json:"channel"`
+	State     string `json:"state"`
+	Received  int64  `json:"received"`
+	Size      int64  `json:"size"`
+	PayloadID string `json:"payloadId"`
+	Error     string `json:"error"`
+}
+
+func (j fetchJob) progress() string {
+	if j.Size < 0 {
+		return fmt.Sprintf("%v bytes", j.Received)
+	}
+	return fmt.Sprintf("%v/%v bytes", j.Received, j.Size)
+}
+
+type fetchCommand struct {
+	Version          string `short:"v" long:"version" required:"yes" description:"version of the payload"`
+	Channel          string `short:"c" long:"channel" required:"yes" description:"channel to add the payload to"`
+	SHA1             string `long:"sha1" required:"yes" description:"expected base64-encoded SHA1 of the payload"`
+	SHA256           string `long:"sha256" required:"yes" description:"expected base64-encoded SHA256 of the payload"`
+	MinSourceVersion string `long:"min-source-version" description:"oldest version the payload can be installed from"`
+	RequiredStop     bool   `long:"required-stop" description:"machines below this version must install it before any newer one"`
+	Wait             bool   `short:"w" long:"wait" description:"wait until the payload is added, showing the progress"`
+	Args             struct {
+		URL string `positional-arg-name:"URL"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *fetchCommand) Execute(args []string) error {
+	query := url.Values{}
+	query.Set("url", c.Args.URL)
+	query.Set("version", c.Version)
+	query.Set("channel", c.Channel)
+	query.Set("sha1", c.SHA1)
+	query.Set("sha256", c.SHA256)
+	if c.MinSourceVersion != "" {
+		query.Set("min_source_version", c.MinSourceVersion)
+	}
+	if c.RequiredStop {
+		query.Set("required_stop", "1")
+	}
+
+	data, err := request("POST", "/admin/add_payload_from_url", query, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	var job fetchJob
+	err = json.Unmarshal(data, &job)
+	if err != nil {
+		return err
+	}
+	if !c.Wait {
+		fmt.Printf("Started job %v\n", job.ID)
+		return nil
+	}
+
+	for job.State != "done" && job.State != "failed" {
+		fmt.Fprintf(os.Stderr, "\r%v: %v   ", job.State, job.progress())
+		time.Sleep(time.Second)
+
+		data, err = request("GET", fmt.Sprintf("/admin/fetch_jobs/%v", job.ID), nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &job)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+
+	if job.State == "failed" {
+		return errors.New(job.Error)
+	}
+	fmt.Printf("Added payload %v\n", job.PayloadID)
+	return nil
+}
+
+type fetchJobsCommand struct{}
+
+func (c *fetchJobsCommand) Execute(args []string) error {
+	var jobs []fetchJob
+	printed, err := getJSON("/admin/fetch_jobs", nil, &jobs)
+	if err != nil || printed {
+		return err
+	}
+
+	table := newTable()
+	fmt.Fprintln(table, "JOB\tSTATE\tVERSION\tCHANNEL\tPROGRESS\tPAYLOAD\tURL\tERROR")
+	for _, j := range jobs {
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", j.ID, j.State, j.Version, j.Channel, j.progress(), j.PayloadID, j.URL, j.Error)
+	}
+	return table.Flush()
+}
+
+type uploadDeltaCommand struct {
+	SourceVersion string `long:"source-version" required:"yes" description:"version the delta applies to"`
+	Target        string `long:"target" required:"yes" description:"ID of the full payload the delta upgrades to"`
+	Args          struct {
+		File string `positional-arg-name:"FILE"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *uploadDeltaCommand) Execute(args []string) error {
+	query := url.Values{}
+	query.Set("source_version", c.SourceVersion)
+	query.Set("target", c.Target)
+
+	return uploadFile("/admin/add_delta", c.Args.File, query)
+}
+
+type channelsCommand struct{}
+
+func (c *channelsCommand) Execute(args []string) error {
+	var channels []string
+	printed, err := getJSON("/admin/channels", nil, &channels)
+	if err != nil || printed {
+		return err
+	}
+
+	for _, channel := range channels {
+		fmt.Println(channel)
+	}
+	return nil
+}
+
+type image struct {
+	ID               string
+	Version          string
+	SHA1             string
+	SHA256           string
+	Size             int64
+	MinSourceVersion string
+	RequiredStop     bool
+	Yanked           bool
+	YankReason       string
+	YankDowngrade    bool
+}
+
+func listImages(channel string) ([]image, error) {
+	data, err := request("GET", "/admin/channel/"+url.PathEscape(channel)+"/images", nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []image
+	err = json.Unmarshal(data, &images)
+	return images, err
+}
+
+type imagesCommand struct {
+	Args struct {
+		Channel string `positional-arg-name:"CHANNEL"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *imagesCommand) Execute(args []string) error {
+	var images []image
+	printed, err := getJSON("/admin/channel/"+url.PathEscape(c.Args.Channel)+"/images", nil, &images)
+	if err != nil || printed {
+		return err
+	}
+
+	table := newTable()
+	fmt.Fprintln(table, "VERSION\tID\tSIZE\tSHA256\tNOTES")
+	for _, img := range images {
+		notes := []string{}
+		if img.RequiredStop {
+			notes = append(notes, "required stop")
+		}
+		if img.MinSourceVersion != "" {
+			notes = append(notes, "from "+img.MinSourceVersion)
+		}
+		if img.Yanked {
+			notes = append(notes, fmt.Sprintf("yanked: %v", img.YankReason))
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\n", img.Version, img.ID, img.Size, img.SHA256, strings.Join(notes, ", "))
+	}
+	return table.Flush()
+}
+
+type payloadArgs struct {
+	Args struct {
+		ID string `positional-arg-name:"PAYLOAD_ID"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type attachCommand struct {
+	Channel string `short:"c" long:"channel" required:"yes" description:"channel to attach the payload to"`
+	payloadArgs
+}
+
+func (c *attachCommand) Execute(args []string) error {
+	query := url.Values{}
+	query.Set("channel", c.Channel)
+	query.Set("payload", c.Args.ID)
+
+	_, err := request("POST", "/admin/attach_payload_to_channel", query, nil, 0)
+	return err
+}
+
+func detach(id, channel string) error {
+	query := url.Values{}
+	query.Set("id", id)
+	query.Set("channel", channel)
+
+	_, err := request("GET", "/admin/delete_payload", query, nil, 0)
+	return err
+}
+
+type detachCommand struct {
+	Channel string `short:"c" long:"channel" required:"yes" description:"channel to remove the payload from"`
+	payloadArgs
+}
+
+func (c *detachCommand) Execute(args []string) error {
+	return detach(c.Args.ID, c.Channel)
+}
+
+type deleteCommand struct {
+	payloadArgs
+}
+
+func (c *deleteCommand) Execute(args []string) error {
+	data, err := request("GET", "/admin/channels", nil, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	var channels []string
+	err = json.Unmarshal(data, &channels)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, channel := range channels {
+		images, err := listImages(channel)
+		if err != nil {
+			return err
+		}
+
+		for _, img := range images {
+			if img.ID != c.Args.ID {
+				continue
+			}
+
+			found = true
+			err = detach(c.Args.ID, channel)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("payload '%v' is not in any channel", c.Args.ID)
+	}
+	return nil
+}
+
+type yankCommand struct {
+	Channel   string `short:"c" long:"channel" required:"yes" description:"channel to yank the payload from"`
+	Reason    string `short:"r" long:"reason" description:"reason shown in the panel"`
+	Downgrade bool   `long:"downgrade" description:"downgrade machines already running the payload"`
+	payloadArgs
+}
+
+func (c *yankCommand) Execute(args []string) error {
+	query := url.Values{}
+	query.Set("id", c.Args.ID)
+	query.Set("channel", c.Channel)
+	query.Set("reason", c.Reason)
+	query.Set("downgrade", boolFlag(c.Downgrade))
+
+	_, err := request("POST", "/admin/yank_payload", query, nil, 0)
+	return err
+}
+
+type unyankCommand struct {
+	Channel string `short:"c" long:"channel" required:"yes" description:"channel to restore the payload in"`
+	payloadArgs
+}
+
+func (c *unyankCommand) Execute(args []string) error {
+	query := url.Values{}
+	query.Set("id", c.Args.ID)
+	query.Set("channel", c.Channel)
+
+	_, err := request("POST", "/admin/unyank_payload", query, nil, 0)
+	return err
+}
+
+type forceDowngradeCommand struct {
+	Args struct {
+		Channel string `positional-arg-name:"CHANNEL" required:"yes"`
+		Value   string `positional-arg-name:"on|off"`
+	} `positional-args:"yes"`
+}
+
+func (c *forceDowngradeCommand) Execute(args []string) error {
+	path := "/admin/channel/" + url.PathEscape(c.Args.Channel) + "/force_downgrade"
+
+	var value string
+	switch c.Args.Value {
+	case "":
+		data, err := request("GET", path, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		enabled := string(data) == "1"
+		if globalOpts.JSON {
+			return json.NewEncoder(os.Stdout).Encode(enabled)
+		}
+		if enabled {
+			fmt.Println("on")
+		} else {
+			fmt.Println("off")
+		}
+		return nil
+	case "on":
+		value = "1"
+	case "off":
+		value = "0"
+	default:
+		return errors.New("the value must be 'on' or 'off'")
+	}
+
+	_, err := request("POST", path, nil, strings.NewReader(value), int64(len(value)))
+	return err
+}
+
+type eventsCommand struct {
+	Machine string `short:"m" long:"machine" description:"machine ID"`
+	Channel string `short:"c" long:"channel" description:"channel"`
+	Version string `short:"v" long:"version" description:"version reported by the machine"`
+	Payload string `short:"p" long:"payload" description:"ID of the payload the event refers to"`
+	Type    string `short:"t" long:"type" description:"event type (download, arrive, apply, success or a number)"`
+	Result  string `short:"r" long:"result" description:"event result (error, ok, done or a number)"`
+	Since   string `long:"since" description:"only events from this time on (RFC 3339, YYYY-MM-DD or unix time)"`
+	Until   string `long:"until" description:"only events before this time"`
+	Page    int    `long:"page" default:"1" description:"page to show"`
+	PerPage int    `long:"per-page" default:"100" description:"events per page (0 for all)"`
+}
+
+type event struct {
+	MachineID       string
+	Timestamp       string
+	Channel         string
+	Version         string
+	PreviousVersion string
+	PayloadID       string
+	TypeName        string
+	ResultName      string
+	ErrorCode       int
+}
+
+func (c *eventsCommand) Execute(args []string) error {
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"machine": c.Machine,
+		"channel": c.Channel,
+		"version": c.Version,
+		"payload": c.Payload,
+		"type":    c.Type,
+		"result":  c.Result,
+		"since":   c.Since,
+		"until":   c.Until,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	query.Set("page", fmt.Sprint(c.Page))
+	query.Set("per_page", fmt.Sprint(c.PerPage))
+
+	var events []event
+	printed, err := getJSON("/admin/events", query, &events)
+	if err != nil || printed {
+		return err
+	}
+
+	table := newTable()
+	fmt.Fprintln(table, "TIMESTAMP\tMACHINE\tCHANNEL\tVERSION\tPAYLOAD\tTYPE\tRESULT\tERROR")
+	for _, ev := range events {
+		errorCode := ""
+		if ev.ErrorCode != 0 {
+			errorCode = fmt.Sprint(ev.ErrorCode)
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", ev.Timestamp, ev.MachineID, ev.Channel, ev.Version, ev.PayloadID, ev.TypeName, ev.ResultName, errorCode)
+	}
+	return table.Flush()
+}
+
+type machinesCommand struct{}
+
+func (c *machinesCommand) Execute(args []string) error {
+	var machines []struct {
+		MachineID  string
+		LastSeen   string
+		RemoteAddr string
+		Version    string
+		Track      string
+		Status     string
+	}
+	printed, err := getJSON("/admin/machines", nil, &machines)
+	if err != nil || printed {
+		return err
+	}
+
+	table := newTable()
+	fmt.Fprintln(table, "MACHINE\tLAST SEEN\tADDRESS\tVERSION\tTRACK\tSTATUS")
+	for _, m := range machines {
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\n", m.MachineID, m.LastSeen, m.RemoteAddr, m.Version, m.Track, m.Status)
+	}
+	return table.Flush()
+}
+
+type machineCommand struct {
+	Limit int `short:"n" long:"limit" default:"20" description:"number of requests to show"`
+	Args  struct {
+		Machine string `positional-arg-name:"MACHINE_ID"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *machineCommand) Execute(args []string) error {
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(c.Limit))
+
+	var requests []struct {
+		Timestamp      string
+		RemoteAddr     string
+		Version        string
+		Track          string
+		UpdateCheck    bool
+		Ping           bool
+		Events         int
+		Status         string
+		OfferedVersion string
+	}
+	printed, err := getJSON("/admin/machine/"+url.PathEscape(c.Args.Machine)+"/requests", query, &requests)
+	if err != nil || printed {
+		return err
+	}
+
+	table := newTable()
+	fmt.Fprintln(table, "TIMESTAMP\tADDRESS\tVERSION\tTRACK\tREQUEST\tSTATUS\tOFFERED")
+	for _, r := range requests {
+		kinds := []string{}
+		if r.UpdateCheck {
+			kinds = append(kinds, "updatecheck")
+		}
+		if r.Ping {
+			kinds = append(kinds, "ping")
+		}
+		if r.Events > 0 {
+			kinds = append(kinds, fmt.Sprintf("%v event(s)", r.Events))
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", r.Timestamp, r.RemoteAddr, r.Version, r.Track, strings.Join(kinds, ", "), r.Status, r.OfferedVersion)
+	}
+	return table.Flush()
+}
+
+type releaseStatsCommand struct{}
+
+func (c *releaseStatsCommand) Execute(args []string) error {
+	var stats []struct {
+		Channel     string
+		PayloadID   string
+		Version     string
+		Machines    int
+		Downloads   int
+		Applied     int
+		Completed   int
+		Failed      int
+		SuccessRate float64
+	}
+	printed, err := getJSON("/admin/release_stats", nil, &stats)
+	if err != nil || printed {
+		return err
+	}
+
+	table := newTable()
+	fmt.Fprintln(table, "CHANNEL\tVERSION\tPAYLOAD\tMACHINES\tDOWNLOADS\tAPPLIED\tCOMPLETED\tFAILED\tSUCCESS")
+	for _, s := range stats {
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%.1f%%\n", s.Channel, s.Version, s.PayloadID, s.Machines, s.Downloads, s.Applied, s.Completed, s.Failed, s.SuccessRate*100)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+// a request as received by the fake server
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Auth   string
+	Body   string
+}
+
+// An admin API answering every request with the response registered for
+// its path, or an empty JSON object
+type fakeServer struct {
+	*httptest.Server
+	requests  []recordedRequest
+	responses map[string]string
+	// called before a request is answered
+	onRequest func(r *http.Request)
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, func()) {
+	s := &fakeServer{responses: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.requests = append(s.requests, recordedRequest{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Auth:   r.Header.Get("Authorization"),
+			Body:   string(body),
+		})
+
+		if s.onRequest != nil {
+			s.onRequest(r)
+		}
+		response, ok := s.responses[r.URL.Path]
+		if !ok {
+			response = "{}"
+		}
+		w.Write([]byte(response))
+	}))
+
+	old := globalOpts
+	globalOpts.Server = s.URL
+	globalOpts.Token = "secret"
+	globalOpts.JSON = false
+
+	return s, func() {
+		s.Close()
+		globalOpts = old
+	}
+}
+
+// the only request made, failing the test otherwise
+func (s *fakeServer) single(t *testing.T) recordedRequest {
+	if len(s.requests) != 1 {
+		t.Fatalf("Expected a single request, got %+v", s.requests)
+	}
+	return s.requests[0]
+}
+
+func writeTempFile(t *testing.T, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "comahactl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := path.Join(dir, "payload")
+	err = ioutil.WriteFile(filename, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filename, func() { os.RemoveAll(dir) }
+}
+
+func TestHashFile(t *testing.T) {
+	filename, cleanup := writeTempFile(t, "abc")
+	defer cleanup()
+
+	hashes, err := hashFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fileHashes{SHA1: "qZk+NkcGgWq6PiVxeFDCbJzQ2J0=", SHA256: "ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=", Size: 3}
+	if hashes != expected {
+		t.Errorf("Expected %+v, got %+v", expected, hashes)
+	}
+}
+
+func TestUploadCommand(t *testing.T) {
+	s, cleanup := newFakeServer(t)
+	defer cleanup()
+	filename, removeFile := writeTempFile(t, "abc")
+	defer removeFile()
+
+	c := &uploadCommand{Version: "800.0.0", Channel: "stable", MinSourceVersion: "766.4.0", RequiredStop: true}
+	c.Args.File = filename
+	err := c.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.single(t)
+	if req.Method != "POST" || req.Path != "/admin/add_payload" || req.Auth != "Bearer secret" || req.Body != "abc" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	expected := url.Values{
+		"version":            {"800.0.0"},
+		"channel":            {"stable"},
+		"min_source_version": {"766.4.0"},
+		"required_stop":      {"1"},
+		"sha1":               {"qZk+NkcGgWq6PiVxeFDCbJzQ2J0="},
+		"sha256":             {"ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0="},
+	}
+	if req.Query.Encode() != expected.Encode() {
+		t.Errorf("Expected query %v, got %v", expected.Encode(), req.Query.Encode())
+	}
+}
+
+func TestUploadChunked(t *testing.T) {
+	s, cleanup := newFakeServer(t)
+	defer cleanup()
+	filename, removeFile := writeTempFile(t, "abcdefgh")
+	defer removeFile()
+
+	s.responses["/admin/uploads"] = `{"id":"u1","size":8,"received":0}`
+	// the server's progress after each chunk
+	chunks := []string{`{"id":"u1","size":8,"received":3}`, `{"id":"u1","size":8,"received":6}`, `{"id":"u1","size":8,"received":8}`}
+	s.onRequest = func(r *http.Request) {
+		if r.Method == "PUT" {
+			s.responses["/admin/uploads/u1"], chunks = chunks[0], chunks[1:]
+		}
+	}
+
+	c := &uploadCommand{Version: "800.0.0", Channel: "stable", ChunkSize: 3}
+	c.Args.File = filename
+	err := c.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.requests) != 5 {
+		t.Fatalf("Expected 5 requests, got %+v", s.requests)
+	}
+	create := s.requests[0]
+	if create.Method != "POST" || create.Path != "/admin/uploads" || create.Query.Get("size") != "8" || create.Query.Get("sha1") == "" {
+		t.Errorf("Unexpected session request %+v", create)
+	}
+	for i, expected := range []struct{ offset, body string }{{"0", "abc"}, {"3", "def"}, {"6", "gh"}} {
+		req := s.requests[i+1]
+		if req.Method != "PUT" || req.Path != "/admin/uploads/u1" || req.Query.Get("offset") != expected.offset || req.Body != expected.body {
+			t.Errorf("Unexpected chunk request %+v", req)
+		}
+	}
+	if finalize := s.requests[4]; finalize.Method != "POST" || finalize.Path != "/admin/uploads/u1/finalize" {
+		t.Errorf("Unexpected finalize request %+v", finalize)
+	}
+}
+
+func TestFetchCommand(t *testing.T) {
+	s, cleanup := newFakeServer(t)
+	defer cleanup()
+	s.responses["/admin/add_payload_from_url"] = `{"id":7,"state":"queued"}`
+
+	c := &fetchCommand{Version: "800.0.0", Channel: "stable", SHA1: "a", SHA256: "b"}
+	c.Args.URL = "http://example.com/update.gz"
+	err := c.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.single(t)
+	expected := url.Values{"url": {"http://example.com/update.gz"}, "version": {"800.0.0"}, "channel": {"stable"}, "sha1": {"a"}, "sha256": {"b"}}
+	if req.Method != "POST" || req.Path != "/admin/add_payload_from_url" || req.Query.Encode() != expected.Encode() {
+		t.Errorf("Unexpected request %+v", req)
+	}
+}
+
+func TestPayloadCommands(t *testing.T) {
+	var p1 payloadArgs
+	p1.Args.ID = "p1"
+
+	tests := []struct {
+		command interface {
+			Execute([]string) error
+		}
+		method string
+		path   string
+		query  url.Values
+	}{
+		{&attachCommand{Channel: "beta", payloadArgs: p1}, "POST", "/admin/attach_payload_to_channel", url.Values{"channel": {"beta"}, "payload": {"p1"}}},
+		{&detachCommand{Channel: "beta", payloadArgs: p1}, "GET", "/admin/delete_payload", url.Values{"id": {"p1"}, "channel": {"beta"}}},
+		{&yankCommand{Channel: "beta", Reason: "broken", Downgrade: true, payloadArgs: p1}, "POST", "/admin/yank_payload", url.Values{"id": {"p1"}, "channel": {"beta"}, "reason": {"broken"}, "downgrade": {"1"}}},
+		{&unyankCommand{Channel: "beta", payloadArgs: p1}, "POST", "/admin/unyank_payload", url.Values{"id": {"p1"}, "channel": {"beta"}}},
+	}
+
+	for _, test := range tests {
+		s, cleanup := newFakeServer(t)
+
+		err := test.command.Execute(nil)
+		if err != nil {
+			t.Errorf("%T: %v", test.command, err.Error())
+		}
+
+		req := s.single(t)
+		if req.Method != test.method || req.Path != test.path || req.Query.Encode() != test.query.Encode() || req.Auth != "Bearer secret" {
+			t.Errorf("%T: unexpected request %+v", test.command, req)
+		}
+
+		cleanup()
+	}
+}
+
+func TestDeleteCommand(t *testing.T) {
+	s, cleanup := newFakeServer(t)
+	defer cleanup()
+	s.responses["/admin/channels"] = `["alpha","beta","stable"]`
+	s.responses["/admin/channel/alpha/images"] = `[{"ID":"p1"}]`
+	s.responses["/admin/channel/beta/images"] = `[{"ID":"p2"}]`
+	s.responses["/admin/channel/stable/images"] = `[{"ID":"p2"},{"ID":"p1"}]`
+
+	c := &deleteCommand{}
+	c.Args.ID = "p1"
+	err := c.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var detached []string
+	for _, req := range s.requests {
+		if req.Path == "/admin/delete_payload" {
+			if req.Query.Get("id") != "p1" {
+				t.Errorf("Unexpected request %+v", req)
+			}
+			detached = append(detached, req.Query.Get("channel"))
+		}
+	}
+	if len(detached) != 2 || detached[0] != "alpha" || detached[1] != "stable" {
+		t.Errorf("Expected the payload to be detached from alpha and stable, got %v", detached)
+	}
+
+	c.Args.ID = "unknown"
+	if err := c.Execute(nil); err == nil {
+		t.Error("Expected an error for a payload in no channel")
+	}
+}
+
+func TestForceDowngradeCommand(t *testing.T) {
+	s, cleanup := newFakeServer(t)
+	defer cleanup()
+
+	c := &forceDowngradeCommand{}
+	c.Args.Channel = "stable"
+	c.Args.Value = "on"
+	err := c.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.single(t)
+	if req.Method != "POST" || req.Path != "/admin/channel/stable/force_downgrade" || req.Body != "1" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+
+	c.Args.Value = "maybe"
+	if err := c.Execute(nil); err == nil {
+		t.Error("Expected an error for an invalid value")
+	}
+}
+
+func TestEventsCommand(t *testing.T) {
+	s, cleanup := newFakeServer(t)
+	defer cleanup()
+	s.responses["/admin/events"] = `[]`
+
+	c := &eventsCommand{Machine: "m1", Type: "apply", Result: "error", Since: "2017-01-01", Page: 2, PerPage: 10}
+	err := c.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.single(t)
+	expected := url.Values{"machine": {"m1"}, "type": {"apply"}, "result": {"error"}, "since": {"2017-01-01"}, "page": {"2"}, "per_page": {"10"}}
+	if req.Method != "GET" || req.Path != "/admin/events" || req.Query.Encode() != expected.Encode() {
+		t.Errorf("Unexpected request %+v", req)
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	defer func(old string) { globalOpts.Server = old }(globalOpts.Server)
+	globalOpts.Server = server.URL
+
+	_, err := request("GET", "/admin/channels", nil, nil, 0)
+	if err == nil || err.Error() != "401 Unauthorized: Invalid token" {
+		t.Errorf("Expected the server's error, got %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+// Simulates a fleet of CoreOS machines updating against a comaha server and
+// reports request latencies and errors.
+package main
+
+import (
+	"fmt"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/kdomanski/comaha/simulator"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var opts struct {
+	Server   string        `short:"s" long:"server" default:"http://127.0.0.1:8080" description:"base URL of the comaha server"`
+	Machines int           `short:"n" long:"machines" default:"1000" description:"number of simulated machines"`
+	Rate     float64       `short:"r" long:"rate" default:"100" description:"Omaha requests per second across all machines"`
+	Duration time.Duration `short:"d" long:"duration" default:"1m" description:"how long to run"`
+	Versions string        `long:"versions" default:"766.4.0,899.17.0,1010.5.0" description:"comma separated versions the machines start with"`
+	Tracks   string        `long:"tracks" default:"stable,beta,alpha" description:"comma separated tracks the machines follow"`
+	Download bool          `long:"download" description:"download offered payloads"`
+	Timeout  time.Duration `long:"timeout" default:"30s" description:"timeout of a single request"`
+}
+
+// what a machine does next
+type step int
+
+const (
+	stepCheck step = iota
+	stepDownloadStarted
+	stepDownloadFinished
+	stepApplied
+	stepRebooted
+)
+
+// a simulated machine and its progress through an update
+type fleetMachine struct {
+	*simulator.Machine
+	next   step
+	update *simulator.Update
+}
+
+// latencies and errors per kind of request
+type stats struct {
+	mutex     sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	skipped   int
+	updated   int
+}
+
+func newStats() *stats {
+	return &stats{
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+	}
+}
+
+func (s *stats) record(kind string, start time.Time, err error) {
+	d := time.Since(start)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.latencies[kind] = append(s.latencies[kind], d)
+	if err != nil {
+		s.errors[fmt.Sprintf("%v: %v", kind, err.Error())]++
+	}
+}
+
+func main() {
+	parser := flags.NewParser(&opts, flags.Default)
+	_, err := parser.Parse()
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+
+	if opts.Machines < 1 || opts.Rate <= 0 {
+		fmt.Fprintln(os.Stderr, "The number of machines and the rate must be positive")
+		os.Exit(1)
+	}
+	versions := splitList(opts.Versions)
+	tracks := splitList(opts.Tracks)
+	if len(versions) == 0 || len(tracks) == 0 {
+		fmt.Fprintln(os.Stderr, "At least one version and one track are required")
+		os.Exit(1)
+	}
+
+	client := &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConns:        opts.Machines,
+			MaxIdleConnsPerHost: opts.Machines,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	// machines not busy with a request
+	idle := make(chan *fleetMachine, opts.Machines)
+	for i := 0; i < opts.Machines; i++ {
+		m := simulator.NewMachine(opts.Server, versions[rand.Intn(len(versions))], tracks[rand.Intn(len(tracks))])
+		m.Client = client
+		idle <- &fleetMachine{Machine: m}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	fmt.Printf("Simulating %v machines at %v requests/s against %v for %v\n", opts.Machines, opts.Rate, opts.Server, opts.Duration)
+
+	s := newStats()
+	var running sync.WaitGroup
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+	deadline := time.After(opts.Duration)
+	start := time.Now()
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case m := <-idle:
+				running.Add(1)
+				go func() {
+					defer running.Done()
+					m.act(s)
+					idle <- m
+				}()
+			default:
+				// every machine is waiting for the server
+				s.mutex.Lock()
+				s.skipped++
+				s.mutex.Unlock()
+			}
+		case <-deadline:
+			break loop
+		case <-sigs:
+			fmt.Println("Interrupted, waiting for running requests")
+			break loop
+		}
+	}
+	ticker.Stop()
+	running.Wait()
+
+	s.report(time.Since(start))
+}
+
+func splitList(s string) []string {
+	out := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// perform the machine's next request, following update_engine's sequence
+func (m *fleetMachine) act(s *stats) {
+	start := time.Now()
+
+	switch m.next {
+	case stepCheck:
+		update, err := m.CheckForUpdate()
+		s.record("updatecheck", start, err)
+		if err == nil && update != nil {
+			m.update = update
+			m.next = stepDownloadStarted
+		}
+
+	case stepDownloadStarted:
+		err := m.ReportEvent(simulator.EventTypeDownload, simulator.EventResultOK, 0)
+		s.record("event", start, err)
+		if err != nil {
+			m.next = stepCheck
+			return
+		}
+		m.next = stepDownloadFinished
+
+		if opts.Download {
+			start = time.Now()
+			_, err = m.Download(m.update)
+			s.record("download", start, err)
+			if err != nil {
+				m.ReportEvent(simulator.EventTypeApply, simulator.EventResultError, 1)
+				m.next = stepCheck
+			}
+		}
+
+	case stepDownloadFinished:
+		err := m.ReportEvent(simulator.EventTypeArrive, simulator.EventResultOK, 0)
+		s.record("event", start, err)
+		m.advance(err, stepApplied)
+
+	case stepApplied:
+		err := m.ReportEvent(simulator.EventTypeApply, simulator.EventResultOK, 0)
+		s.record("event", start, err)
+		m.advance(err, stepRebooted)
+
+	case stepRebooted:
+		m.Reboot(m.update.Version)
+		err := m.ReportEvent(simulator.EventTypeApply, simulator.EventResultDone, 0)
+		s.record("event", start, err)
+		m.PreviousVersion = ""
+		m.next = stepCheck
+		if err == nil {
+			s.mutex.Lock()
+			s.updated++
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// continue with 'next', or start over after an error
+func (m *fleetMachine) advance(err error, next step) {
+	if err != nil {
+		m.next = stepCheck
+	} else {
+		m.next = next
+	}
+}
+
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func (s *stats) report(elapsed time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	total := 0
+	kinds := []string{}
+	for kind, latencies := range s.latencies {
+		kinds = append(kinds, kind)
+		total += len(latencies)
+	}
+	sort.Strings(kinds)
+
+	fmt.Printf("\n%v requests in %v (%.1f/s), %v updates completed, %v ticks skipped with all machines busy\n\n",
+		total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), s.updated, s.skipped)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REQUEST\tCOUNT\tERRORS\tP50\tP90\tP99\tMAX")
+	for _, kind := range kinds {
+		latencies := s.latencies[kind]
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		errors := 0
+		for msg, n := range s.errors {
+			if strings.HasPrefix(msg, kind+": ") {
+				errors += n
+			}
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", kind, len(latencies), errors,
+			percentile(latencies, 0.5), percentile(latencies, 0.9), percentile(latencies, 0.99), latencies[len(latencies)-1])
+	}
+	w.Flush()
+
+	if len(s.errors) > 0 {
+		messages := []string{}
+		for msg := range s.errors {
+			messages = append(messages, msg)
+		}
+		sort.Slice(messages, func(i, j int) bool { return s.errors[messages[i]] > s.errors[messages[j]] })
+
+		fmt.Println("\nErrors:")
+		for _, msg := range messages {
+			fmt.Printf("%6d  %v\n", s.errors[msg], msg)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+// a channel's payload with its version and upgrade constraints already parsed
+type chainPayload struct {
+	payload
+
+	version   payloadVersion
+	minSource *payloadVersion
+}
+
+// Pick the payload a client running 'current' should be offered next.
+// 'images' must be sorted by ascending version.
+//
+// Payloads marked as required stops cannot be skipped: a client below one is
+// only offered versions up to and including that stop. Within that range the
+// newest payload whose minimum source version the client satisfies wins.
+// Yanked payloads are never offered, but a yanked required stop still ends
+// the range, so its clients wait at the newest good version below it.
+// Returns nil if no payload is applicable.
+func nextPayloadInChain(current payloadVersion, images []chainPayload) *payload {
+	var chosen *payload
+
+	for i := range images {
+		image := &images[i]
+		if !image.version.IsGreater(current) {
+			continue
+		}
+
+		if !image.Yanked && (image.minSource == nil || !image.minSource.IsGreater(current)) {
+			chosen = &image.payload
+		}
+
+		if image.RequiredStop {
+			break
+		}
+	}
+
+	return chosen
+}
+
+// Machines running a payload which was yanked with the downgrade option are
+// sent back to the newest good version below it. 'images' holds the whole
+// channel, 'good' only its payloads which were not yanked, both sorted by
+// ascending version.
+func downgradeFromYanked(current payloadVersion, images, good []chainPayload) *payload {
+	runsYanked := false
+	for _, image := range images {
+		if image.Yanked && image.YankDowngrade && image.version.IsEqual(current) {
+			runsYanked = true
+			break
+		}
+	}
+
+	if !runsYanked {
+		return nil
+	}
+
+	for i := len(good) - 1; i >= 0; i-- {
+		if current.IsGreater(good[i].version) {
+			return &good[i].payload
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often abandoned upload sessions are looked for, at most
+const uploadCleanupInterval = 10 * time.Minute
+
+// IDs of upload sessions as generated by newUploadID
+var validUploadID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+var (
+	errUploadNotFound   = errors.New("Unknown upload session")
+	errUploadBusy       = errors.New("Upload session is in use by another request")
+	errUploadIncomplete = errors.New("Upload is incomplete")
+	errUploadTooLarge   = errors.New("Chunk exceeds the size of the upload")
+)
+
+// returned when a chunk does not continue where the upload stands
+type uploadOffsetError struct {
+	expected int64
+}
+
+func (e *uploadOffsetError) Error() string {
+	return fmt.Sprintf("Expected a chunk at offset %v", e.expected)
+}
+
+// state of an upload session as reported by the admin API
+type uploadSession struct {
+	ID       string    `json:"id"`
+	Version  string    `json:"version"`
+	Channel  string    `json:"channel"`
+	Size     int64     `json:"size"`
+	Received int64     `json:"received"`
+	Expires  time.Time `json:"expires"`
+}
+
+// kept in '<id>.json' next to the data in '<id>.part'
+type uploadMeta struct {
+	// parameters of /admin/add_payload the payload is added with
+	Query string `json:"query"`
+	Size  int64  `json:"size"`
+}
+
+// Payloads uploaded in chunks, kept on disk so that uploads can be resumed
+// after a dropped connection or a restart. Sessions which receive no data
+// for 'timeout' are removed.
+type uploadStore struct {
+	dir     string
+	timeout time.Duration
+
+	// sessions being written to or finalized
+	mutex sync.Mutex
+	busy  map[string]bool
+}
+
+// nil if chunked uploads are not available
+var uploads *uploadStore
+
+func newUploadStore(dir string, timeout time.Duration) (*uploadStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &uploadStore{dir: dir, timeout: timeout, busy: make(map[string]bool)}, nil
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *uploadStore) dataPath(id string) string {
+	return path.Join(s.dir, id+".part")
+}
+
+func (s *uploadStore) metaPath(id string) string {
+	return path.Join(s.dir, id+".json")
+}
+
+// start an upload of 'size' bytes, to be added with the parameters in 'query'
+func (s *uploadStore) create(query url.Values, size int64) (uploadSession, error) {
+	id, err := newUploadID()
+	if err != nil {
+		return uploadSession{}, err
+	}
+
+	meta, err := json.Marshal(uploadMeta{Query: query.Encode(), Size: size})
+	if err != nil {
+		return uploadSession{}, err
+	}
+
+	// the data file is created first, as sessions without metadata are ignored
+	err = ioutil.WriteFile(s.dataPath(id), nil, 0644)
+	if err == nil {
+		err = ioutil.WriteFile(s.metaPath(id), meta, 0644)
+	}
+	if err != nil {
+		os.Remove(s.dataPath(id))
+		return uploadSession{}, err
+	}
+
+	return s.session(id)
+}
+
+func (s *uploadStore) readMeta(id string) (*uploadMeta, error) {
+	if !validUploadID.MatchString(id) {
+		return nil, errUploadNotFound
+	}
+
+	data, err := ioutil.ReadFile(s.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta uploadMeta
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("reading upload session '%v': %v", id, err.Error())
+	}
+	return &meta, nil
+}
+
+func (s *uploadStore) session(id string) (uploadSession, error) {
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return uploadSession{}, err
+	}
+
+	info, err := os.Stat(s.dataPath(id))
+	if os.IsNotExist(err) {
+		return uploadSession{}, errUploadNotFound
+	}
+	if err != nil {
+		return uploadSession{}, err
+	}
+
+	query, _ := url.ParseQuery(meta.Query)
+	return uploadSession{
+		ID:       id,
+		Version:  query.Get("version"),
+		Channel:  query.Get("channel"),
+		Size:     meta.Size,
+		Received: info.Size(),
+		Expires:  info.ModTime().Add(s.timeout).UTC(),
+	}, nil
+}
+
+// all sessions, by ID
+func (s *uploadStore) list() ([]uploadSession, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, entry := range entries {
+		if id := strings.TrimSuffix(entry.Name(), ".json"); id != entry.Name() && validUploadID.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	sessions := []uploadSession{}
+	for _, id := range ids {
+		session, err := s.session(id)
+		if err == errUploadNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// reserve a session for one request at a time
+func (s *uploadStore) acquire(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.busy[id] {
+		return errUploadBusy
+	}
+	s.busy[id] = true
+	return nil
+}
+
+func (s *uploadStore) release(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.busy, id)
+}
+
+// Append a chunk which starts at 'offset'. Data received before a failure
+// is kept, so the client can continue from the reported progress.
+func (s *uploadStore) write(id string, offset int64, chunk io.Reader) (uploadSession, error) {
+	err := s.acquire(id)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	defer s.release(id)
+
+	session, err := s.session(id)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	if offset != session.Received {
+		return session, &uploadOffsetError{expected: session.Received}
+	}
+
+	file, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return session, err
+	}
+	defer file.Close()
+
+	written, err := io.Copy(file, io.LimitReader(chunk, session.Size-offset))
+	if err == nil {
+		// anything beyond the announced size rejects the whole chunk
+		var extra [1]byte
+		if n, _ := chunk.Read(extra[:]); n > 0 {
+			err = file.Truncate(offset)
+			if err == nil {
+				written = 0
+				err = errUploadTooLarge
+			}
+		}
+	}
+
+	session.Received += written
+	return session, err
+}
+
+// add the completely uploaded payload and end the session; returns the payload's ID
+func (s *uploadStore) finalize(id string) (string, error) {
+	defer runtime.GC()
+
+	err := s.acquire(id)
+	if err != nil {
+		return "", err
+	}
+	defer s.release(id)
+
+	session, err := s.session(id)
+	if err != nil {
+		return "", err
+	}
+	if session.Received != session.Size {
+		return "", errUploadIncomplete
+	}
+
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return "", err
+	}
+	query, err := url.ParseQuery(meta.Query)
+	if err != nil {
+		return "", err
+	}
+	params, err := parsePayloadParams(query)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(s.dataPath(id))
+	if err != nil {
+		return "", err
+	}
+
+	payloadID, err := params.add(data)
+	if _, ok := err.(*hashMismatchError); ok {
+		// the data is useless, the client has to start over
+		s.remove(id)
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return payloadID, s.remove(id)
+}
+
+// delete a session and its data
+func (s *uploadStore) remove(id string) error {
+	if !validUploadID.MatchString(id) {
+		return errUploadNotFound
+	}
+
+	err := os.Remove(s.metaPath(id))
+	if os.IsNotExist(err) {
+		return errUploadNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(s.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// remove the sessions which expired before 'now'; returns their number
+func (s *uploadStore) cleanup(now time.Time) int {
+	sessions, err := s.list()
+	if err != nil {
+		log.Errorf("Upload cleanup: %v", err.Error())
+		return 0
+	}
+
+	removed := 0
+	for _, session := range sessions {
+		if session.Expires.After(now) || s.acquire(session.ID) != nil {
+			continue
+		}
+
+		err = s.remove(session.ID)
+		s.release(session.ID)
+		if err != nil {
+			log.Errorf("Upload cleanup: removing session '%v': %v", session.ID, err.Error())
+			continue
+		}
+
+		log.Infof("Upload cleanup: removed abandoned upload of %v to '%v' (%v of %v bytes)", session.Version, session.Channel, session.Received, session.Size)
+		removed++
+	}
+	return removed
+}
+
+// periodically remove abandoned upload sessions until 'stop' is closed
+func runUploadCleanup(stop <-chan struct{}) {
+	if uploads == nil {
+		return
+	}
+
+	interval := uploadCleanupInterval
+	if uploads.timeout < interval {
+		interval = uploads.timeout
+	}
+
+	for {
+		uploads.cleanup(time.Now())
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// report an error of the upload store with the matching status
+func writeUploadError(w http.ResponseWriter, handler string, err error) {
+	switch err.(type) {
+	case *uploadOffsetError:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case *hashMismatchError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch err {
+	case errUploadNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errUploadBusy, errUploadIncomplete:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errUploadTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		log.Errorf("%v: %v", handler, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeUploadSession(w http.ResponseWriter, handler string, status int, session uploadSession) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Received, 10))
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(session)
+	if err != nil {
+		log.Errorf("%v: encoding response: %v", handler, err.Error())
+	}
+}
+
+func createUploadHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	query := r.URL.Query()
+	_, err := parsePayloadParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || size < 1 {
+		http.Error(w, "Parameter 'size' must be a positive number of bytes", 400)
+		return
+	}
+	if size > opts.MaxPayloadSize {
+		http.Error(w, fmt.Sprintf("Upload of %v bytes exceeds the limit of %v", size, opts.MaxPayloadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	query.Del("size")
+
+	if uploads == nil {
+		http.Error(w, "Chunked uploads are not available", http.StatusServiceUnavailable)
+		return
+	}
+	session, err := uploads.create(query, size)
+	if err != nil {
+		writeUploadError(w, "createUploadHandler", err)
+		return
+	}
+
+	log.Infof("Started upload %v of %v bytes for version %v in channel '%v'", session.ID, size, session.Version, session.Channel)
+	w.Header().Set("Location", "/admin/uploads/"+session.ID)
+	writeUploadSession(w, "createUploadHandler", http.StatusCreated, session)
+}
+
+func uploadsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	sessions := []uploadSession{}
+	if uploads != nil {
+		var err error
+		sessions, err = uploads.list()
+		if err != nil {
+			writeUploadError(w, "uploadsHandler", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(sessions)
+	if err != nil {
+		log.Errorf("uploadsHandler: encoding response: %v", err.Error())
+	}
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+
+	if uploads == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, err := uploads.session(ps.ByName("id"))
+	if err != nil {
+		writeUploadError(w, "uploadHandler", err)
+		return
+	}
+
+	writeUploadSession(w, "uploadHandler", http.StatusOK, session)
+}
+
+func uploadChunkHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Parameter 'offset' must be a non-negative number of bytes", 400)
+		return
+	}
+
+	if uploads == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, err := uploads.write(ps.ByName("id"), offset, r.Body)
+	if err != nil {
+		if session.ID != "" {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(session.Received, 10))
+		}
+		writeUploadError(w, "uploadChunkHandler", err)
+		return
+	}
+
+	writeUploadSession(w, "uploadChunkHandler", http.StatusOK, session)
+}
+
+func finalizeUploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+
+	if uploads == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := uploads.finalize(ps.ByName("id"))
+	if err != nil {
+		writeUploadError(w, "finalizeUploadHandler", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]string{"payloadId": id})
+	if err != nil {
+		log.Errorf("finalizeUploadHandler: encoding response: %v", err.Error())
+	}
+}
+
+func deleteUploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+
+	if uploads == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	id := ps.ByName("id")
+	err := uploads.acquire(id)
+	if err != nil {
+		writeUploadError(w, "deleteUploadHandler", err)
+		return
+	}
+	defer uploads.release(id)
+
+	err = uploads.remove(id)
+	if err != nil {
+		writeUploadError(w, "deleteUploadHandler", err)
+	}
+}
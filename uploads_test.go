@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// perform a request against the upload API and decode the JSON answer into 'out'
+func (s *conformanceServer) uploadRequest(method, path string, body []byte, expected int, out interface{}) *http.Response {
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != expected {
+		s.t.Fatalf("%v %v: expected status %v, got %v %s", method, path, expected, resp.StatusCode, data)
+	}
+	if out != nil {
+		err = json.Unmarshal(data, out)
+		if err != nil {
+			s.t.Fatalf("%v %v: %v", method, path, err.Error())
+		}
+	}
+	return resp
+}
+
+func newTestUploads(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "comaha-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := uploads
+	uploads, err = newUploadStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		os.RemoveAll(dir)
+		uploads = old
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+	defer newTestUploads(t)()
+
+	data := []byte("full image of 800.0.0, uploaded in three chunks")
+	sha1, sha256 := payloadHashes(data)
+	params := url.Values{"sha1": {sha1}, "sha256": {sha256}, "version": {"800.0.0"}, "channel": {"stable"}, "size": {fmt.Sprint(len(data))}}
+
+	var session uploadSession
+	resp := s.uploadRequest("POST", "/admin/uploads?"+params.Encode(), nil, http.StatusCreated, &session)
+	location := resp.Header.Get("Location")
+	if session.Size != int64(len(data)) || session.Received != 0 || session.Version != "800.0.0" || location != "/admin/uploads/"+session.ID {
+		t.Fatalf("Unexpected session %+v at '%v'", session, location)
+	}
+
+	s.uploadRequest("PUT", location+"?offset=0", data[:10], http.StatusOK, &session)
+	if session.Received != 10 {
+		t.Errorf("Expected 10 bytes received, got %+v", session)
+	}
+
+	// chunks must continue where the upload stands
+	resp = s.uploadRequest("PUT", location+"?offset=5", data[5:20], http.StatusConflict, nil)
+	if offset := resp.Header.Get("Upload-Offset"); offset != "10" {
+		t.Errorf("Expected the current offset 10, got '%v'", offset)
+	}
+	s.uploadRequest("PUT", location+"?offset=10", append(append([]byte{}, data[10:]...), "too much"...), http.StatusRequestEntityTooLarge, nil)
+
+	s.uploadRequest("PUT", location+"?offset=10", data[10:30], http.StatusOK, nil)
+	s.uploadRequest("POST", location+"/finalize", nil, http.StatusConflict, nil)
+
+	// the upload survives a restart
+	uploads, _ = newUploadStore(uploads.dir, uploads.timeout)
+	s.uploadRequest("GET", location, nil, http.StatusOK, &session)
+	if session.Received != 30 {
+		t.Errorf("Expected 30 bytes received, got %+v", session)
+	}
+
+	s.uploadRequest("PUT", location+"?offset=30", data[30:], http.StatusOK, nil)
+
+	var result struct {
+		PayloadID string `json:"payloadId"`
+	}
+	s.uploadRequest("POST", location+"/finalize", nil, http.StatusOK, &result)
+
+	images, err := db.ListImages("stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ID != result.PayloadID || images[0].Size != int64(len(data)) {
+		t.Fatalf("Expected the uploaded payload in the channel, got %+v", images)
+	}
+	update, err := s.machine("766.4.0", "stable").Update()
+	if err != nil || update == nil || update.ID != result.PayloadID {
+		t.Errorf("Expected the uploaded payload to be installed, got %+v, %v", update, err)
+	}
+
+	// the session ends with the upload
+	s.uploadRequest("GET", location, nil, http.StatusNotFound, nil)
+	var sessions []uploadSession
+	s.uploadRequest("GET", "/admin/uploads", nil, http.StatusOK, &sessions)
+	if len(sessions) != 0 {
+		t.Errorf("Expected no sessions, got %+v", sessions)
+	}
+}
+
+func TestChunkedUploadHashMismatch(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+	defer newTestUploads(t)()
+
+	sha1, sha256 := payloadHashes([]byte("expected data"))
+	params := url.Values{"sha1": {sha1}, "sha256": {sha256}, "version": {"800.0.0"}, "channel": {"stable"}, "size": {"8"}}
+
+	var session uploadSession
+	s.uploadRequest("POST", "/admin/uploads?"+params.Encode(), nil, http.StatusCreated, &session)
+	s.uploadRequest("PUT", "/admin/uploads/"+session.ID+"?offset=0", []byte("bad data"), http.StatusOK, nil)
+	s.uploadRequest("POST", "/admin/uploads/"+session.ID+"/finalize", nil, http.StatusBadRequest, nil)
+
+	if images, _ := db.ListImages("stable"); len(images) != 0 {
+		t.Errorf("Expected no payload to be added, got %+v", images)
+	}
+	s.uploadRequest("GET", "/admin/uploads/"+session.ID, nil, http.StatusNotFound, nil)
+
+	// sessions are only created for valid payload parameters
+	params.Del("version")
+	s.uploadRequest("POST", "/admin/uploads?"+params.Encode(), nil, http.StatusBadRequest, nil)
+
+	// and within --max-payload-size
+	params.Set("version", "800.0.0")
+	opts.MaxPayloadSize = 4
+	s.uploadRequest("POST", "/admin/uploads?"+params.Encode(), nil, http.StatusRequestEntityTooLarge, nil)
+}
+
+func TestUploadCleanup(t *testing.T) {
+	defer newTestUploads(t)()
+
+	abandoned, err := uploads.create(url.Values{"version": {"800.0.0"}}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := uploads.create(url.Values{"version": {"900.0.0"}}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastWrite := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(uploads.dataPath(abandoned.ID), lastWrite, lastWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := uploads.cleanup(time.Now()); removed != 1 {
+		t.Errorf("Expected one session to be removed, got %v", removed)
+	}
+
+	sessions, err := uploads.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != active.ID {
+		t.Errorf("Expected only the active session to remain, got %+v", sessions)
+	}
+	if _, err := os.Stat(uploads.dataPath(abandoned.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the data of the abandoned session to be removed")
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// how long fetching a release from an upstream server may take, including
+	// the download of the payload
+	upstreamTimeout = time.Hour
+	// limit for update check responses, which only describe a release
+	upstreamMaxResponseSize = 1 << 20
+)
+
+var upstreamClient = &http.Client{Timeout: upstreamTimeout}
+
+// an upstream server as given in the 'upstreams' section of the configuration file
+type upstreamConfig struct {
+	Name string `yaml:"name"`
+	// update endpoint, e.g. https://public.update.core-os.net/v1/update/
+	URL   string `yaml:"url"`
+	AppID string `yaml:"app_id"`
+	// local channel to import into, by upstream track
+	Channels map[string]string `yaml:"channels"`
+}
+
+// An Omaha server new releases are imported from. For each track, comaha
+// asks it for an update from the newest version in the local channel, as a
+// machine following that track would, and adds the offered payload.
+type upstream struct {
+	name   string
+	url    string
+	appID  string
+	tracks []*upstreamTrack
+}
+
+// a track imported from an upstream server
+type upstreamTrack struct {
+	track   string
+	channel string
+
+	mutex  sync.Mutex
+	status upstreamStatus
+}
+
+// a release offered by an upstream server
+type upstreamRelease struct {
+	version string
+	urls    []string
+	sha1    string
+	sha256  string
+	size    int64
+	isDelta bool
+}
+
+// state of importing one track, as reported by the admin API
+type upstreamStatus struct {
+	Upstream     string    `json:"upstream"`
+	Track        string    `json:"track"`
+	Channel      string    `json:"channel"`
+	LastCheck    time.Time `json:"lastCheck"`
+	LastImported string    `json:"lastImported,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+// configured upstream servers, in the order of the configuration file
+var upstreams []*upstream
+
+// set up the upstream servers from the configuration file
+func setUpstreams(configured []upstreamConfig) error {
+	known := make(map[string]bool)
+	channels := make(map[string]string)
+	var result []*upstream
+
+	for _, c := range configured {
+		if c.Name == "" {
+			return errors.New("an upstream is missing its 'name'")
+		}
+		if known[c.Name] {
+			return fmt.Errorf("upstream '%v' is configured more than once", c.Name)
+		}
+		known[c.Name] = true
+
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("upstream '%v': invalid URL '%v'", c.Name, c.URL)
+		}
+		if len(c.Channels) == 0 {
+			return fmt.Errorf("upstream '%v': no channels to import into", c.Name)
+		}
+
+		appID := c.AppID
+		if appID == "" {
+			appID = coreOSAppID
+		}
+
+		up := &upstream{name: c.Name, url: c.URL, appID: appID}
+		for track, channel := range c.Channels {
+			if track == "" || channel == "" {
+				return fmt.Errorf("upstream '%v': empty track or channel", c.Name)
+			}
+			// two sources for one channel would offer each other's versions
+			if other, ok := channels[channel]; ok {
+				return fmt.Errorf("channel '%v' is imported from both %v and upstream '%v'", channel, other, c.Name)
+			}
+			channels[channel] = fmt.Sprintf("upstream '%v'", c.Name)
+
+			up.tracks = append(up.tracks, &upstreamTrack{
+				track:   track,
+				channel: channel,
+				status:  upstreamStatus{Upstream: c.Name, Track: track, Channel: channel},
+			})
+		}
+		sort.Slice(up.tracks, func(i, j int) bool { return up.tracks[i].track < up.tracks[j].track })
+
+		result = append(result, up)
+	}
+
+	upstreams = result
+	return nil
+}
+
+// periodically import new releases from the upstream servers until 'stop'
+// is closed, which also aborts a running update check or download
+func runUpstreamSync(interval time.Duration, stop <-chan struct{}) {
+	if len(upstreams) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		for _, up := range upstreams {
+			for _, track := range up.tracks {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				up.sync(ctx, track)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// import the release the upstream offers for the track, if it is newer
+// than everything in the local channel
+func (up *upstream) sync(ctx context.Context, track *upstreamTrack) {
+	imported, err := up.importNewer(ctx, track.track, track.channel)
+	if err != nil {
+		log.Errorf("Upstream '%v': importing track '%v': %v", up.name, track.track, err.Error())
+	}
+
+	track.mutex.Lock()
+	defer track.mutex.Unlock()
+
+	track.status.LastCheck = time.Now().UTC()
+	track.status.LastError = ""
+	if err != nil {
+		track.status.LastError = err.Error()
+	}
+	if imported != "" {
+		track.status.LastImported = imported
+	}
+}
+
+// returns the version imported, empty if the channel is up to date
+func (up *upstream) importNewer(ctx context.Context, track, channel string) (string, error) {
+	images, err := db.ListImages(channel)
+	if err != nil {
+		return "", fmt.Errorf("listing channel: %v", err.Error())
+	}
+
+	// an empty channel gets the upstream's current release
+	current := payloadVersion{timestamp: time.Unix(0, 0).UTC()}
+	for _, image := range images {
+		v, err := parseVersionString(image.Version)
+		if err == nil && v.IsGreater(current) {
+			current = v
+		}
+	}
+
+	release, err := up.checkForUpdate(ctx, current.String(), track)
+	if err != nil {
+		return "", fmt.Errorf("checking for update: %v", err.Error())
+	}
+	if release == nil {
+		return "", nil
+	}
+
+	version, err := parseVersionString(release.version)
+	if err != nil {
+		return "", fmt.Errorf("offered version '%v': %v", release.version, err.Error())
+	}
+	if !version.IsGreater(current) {
+		log.Debugf("Upstream '%v' offers version %v for track '%v', not newer than %v", up.name, version, track, current)
+		return "", nil
+	}
+	if release.isDelta {
+		return "", fmt.Errorf("offered a delta payload for version %v", version)
+	}
+	if release.sha1 == "" || release.sha256 == "" {
+		return "", fmt.Errorf("offered version %v without SHA1 and SHA256 hashes", version)
+	}
+
+	log.Infof("Upstream '%v': downloading version %v for channel '%v'", up.name, version, channel)
+	data, err := up.download(ctx, release)
+	if err != nil {
+		return "", fmt.Errorf("downloading version %v: %v", version, err.Error())
+	}
+
+	id, err := addPayload(data, release.sha1, release.sha256, version, channel, nil, false)
+	if err != nil {
+		return "", fmt.Errorf("adding version %v: %v", version, err.Error())
+	}
+	log.Infof("Upstream '%v': imported version %v into channel '%v' as payload %v", up.name, version, channel, id)
+
+	return version.String(), nil
+}
+
+// ask the upstream for an update from 'version' on 'track' like
+// update_engine does; returns nil if there is none
+func (up *upstream) checkForUpdate(ctx context.Context, version, track string) (*upstreamRelease, error) {
+	req := omaha.NewRequest("Chateau", "CoreOS", version+"_x86_64", "")
+	app := req.AddApp(up.appID, version)
+	app.MachineID = "comaha-upstream-" + up.name
+	app.Track = track
+	app.AddUpdateCheck()
+
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", up.url, bytes.NewReader(append([]byte(xml.Header), body...)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "text/xml")
+
+	resp, err := upstreamClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status '%v'", resp.Status)
+	}
+
+	var omahaResp omaha.Response
+	err = xml.NewDecoder(io.LimitReader(resp.Body, upstreamMaxResponseSize)).Decode(&omahaResp)
+	if err != nil {
+		return nil, fmt.Errorf("parsing response: %v", err.Error())
+	}
+
+	var respApp *omaha.App
+	for _, a := range omahaResp.Apps {
+		if a.Id == up.appID {
+			respApp = a
+		}
+	}
+	if respApp == nil {
+		return nil, errors.New("response contains no app")
+	}
+	if respApp.Status != "ok" {
+		return nil, fmt.Errorf("app status '%v'", respApp.Status)
+	}
+
+	uc := respApp.UpdateCheck
+	if uc == nil {
+		return nil, errors.New("response contains no updatecheck")
+	}
+	switch uc.Status {
+	case "noupdate":
+		return nil, nil
+	case "ok":
+	default:
+		return nil, fmt.Errorf("updatecheck status '%v'", uc.Status)
+	}
+
+	if uc.Urls == nil || len(uc.Urls.Urls) == 0 || uc.Manifest == nil || len(uc.Manifest.Packages.Packages) == 0 {
+		return nil, errors.New("update without URL or package")
+	}
+
+	pkg := uc.Manifest.Packages.Packages[0]
+	size, err := strconv.ParseInt(pkg.Size, 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid package size '%v'", pkg.Size)
+	}
+
+	release := &upstreamRelease{
+		version: uc.Manifest.Version,
+		sha1:    pkg.Hash,
+		size:    size,
+	}
+	for _, u := range uc.Urls.Urls {
+		release.urls = append(release.urls, u.CodeBase+pkg.Name)
+	}
+	for _, action := range uc.Manifest.Actions.Actions {
+		if action.Event == "postinstall" {
+			release.sha256 = action.Sha256
+			release.isDelta = action.IsDelta
+		}
+	}
+
+	return release, nil
+}
+
+// download the release from the first of its URLs which works; the error of
+// the last URL is returned if none does
+func (up *upstream) download(ctx context.Context, release *upstreamRelease) ([]byte, error) {
+	var err error
+	for _, u := range release.urls {
+		var data []byte
+		data, err = up.downloadFrom(ctx, u, release.size)
+		if err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warnf("Upstream '%v': downloading '%v': %v", up.name, u, err.Error())
+	}
+	return nil, err
+}
+
+// download exactly 'size' bytes, the size announced in the manifest
+func (up *upstream) downloadFrom(ctx context.Context, url string, size int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := upstreamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status '%v'", resp.Status)
+	}
+	if resp.ContentLength > size {
+		return nil, fmt.Errorf("response of %v bytes is larger than the %v bytes in the manifest", resp.ContentLength, size)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > size {
+		return nil, fmt.Errorf("received more than the %v bytes in the manifest", size)
+	}
+	if int64(len(data)) < size {
+		return nil, fmt.Errorf("received %v of %v bytes", len(data), size)
+	}
+
+	return data, nil
+}
+
+func (track *upstreamTrack) currentStatus() upstreamStatus {
+	track.mutex.Lock()
+	defer track.mutex.Unlock()
+
+	return track.status
+}
+
+func upstreamsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	statuses := []upstreamStatus{}
+	for _, up := range upstreams {
+		for _, track := range up.tracks {
+			statuses = append(statuses, track.currentStatus())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(statuses)
+	if err != nil {
+		log.Errorf("upstreamsHandler: encoding response: %v", err.Error())
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/coreos/go-omaha/omaha"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An Omaha server offering a single release on its 'stable' track to
+// machines running an older version
+type fakeUpstream struct {
+	*httptest.Server
+	version string
+	data    []byte
+	// hashes announced in the manifest
+	sha1, sha256 string
+	// sent after the data, beyond the size announced in the manifest
+	trailer []byte
+	// if set, closed when a download starts, which then hangs until the
+	// client gives up
+	downloading chan struct{}
+	checks      []*omaha.App
+}
+
+func newFakeUpstream(version string, data []byte) *fakeUpstream {
+	u := &fakeUpstream{version: version, data: data}
+	u.sha1, u.sha256 = payloadHashes(data)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/update/", u.update)
+	mux.HandleFunc("/files/release", func(w http.ResponseWriter, r *http.Request) {
+		if u.downloading != nil {
+			close(u.downloading)
+			<-r.Context().Done()
+			return
+		}
+		w.Write(u.data)
+		if u.trailer != nil {
+			// without a Content-Length, so that only the body gives it away
+			w.(http.Flusher).Flush()
+			w.Write(u.trailer)
+		}
+	})
+	u.Server = httptest.NewServer(mux)
+
+	return u
+}
+
+func (u *fakeUpstream) update(w http.ResponseWriter, r *http.Request) {
+	var req omaha.Request
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Apps) != 1 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	appReq := req.Apps[0]
+	u.checks = append(u.checks, appReq)
+
+	resp := omaha.NewResponse("upstream")
+	app := resp.AddApp(appReq.Id)
+	app.Status = "ok"
+	uc := app.AddUpdateCheck()
+
+	current, _ := parseVersionString(appReq.Version)
+	offered, _ := parseVersionString(u.version)
+	if appReq.Track != "stable" || !offered.IsGreater(current) {
+		uc.Status = "noupdate"
+	} else {
+		uc.Status = "ok"
+		uc.AddUrl(u.URL + "/files/")
+		manifest := uc.AddManifest(u.version)
+		manifest.AddPackage(u.sha1, "release", strconv.Itoa(len(u.data)), true)
+		action := manifest.AddAction("postinstall")
+		action.Sha256 = u.sha256
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(resp)
+}
+
+func TestUpstreamImport(t *testing.T) {
+	s, cleanup := newConformanceServer(t)
+	defer cleanup()
+	defer func(old []*upstream) { upstreams = old }(upstreams)
+
+	data := []byte("upstream image of 900.0.0")
+	u := newFakeUpstream("900.0.0", data)
+	defer u.Close()
+
+	err := setUpstreams([]upstreamConfig{{Name: "coreos", URL: u.URL + "/v1/update/", Channels: map[string]string{"stable": "imported", "beta": "imported-beta"}}})
+	if err != nil {
+		t.Fatalf("setUpstreams: %v", err.Error())
+	}
+	s.addPayload("800.0.0", "imported", []byte("local image of 800.0.0"))
+
+	up := upstreams[0]
+	for _, track := range up.tracks {
+		up.sync(context.Background(), track)
+	}
+
+	if len(u.checks) != 2 || u.checks[0].Track != "beta" || u.checks[0].Version != "0.0.0" ||
+		u.checks[1].Track != "stable" || u.checks[1].Version != "800.0.0" || u.checks[1].Id != coreOSAppID {
+		t.Errorf("Unexpected update checks %+v", u.checks)
+	}
+
+	images, err := db.ListImages("imported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[1].Version != "900.0.0" || images[1].SHA1 != u.sha1 || images[1].SHA256 != u.sha256 {
+		t.Fatalf("Expected version 900.0.0 to be imported, got %+v", images)
+	}
+
+	// served to local machines like an uploaded payload
+	m := s.machine("800.0.0", "imported")
+	update, err := m.Update()
+	if err != nil || update == nil || update.Version != "900.0.0" {
+		t.Errorf("Expected the imported version to be installed, got %+v, %v", update, err)
+	}
+
+	status := up.tracks[1].currentStatus()
+	if status.LastImported != "900.0.0" || status.LastError != "" || status.LastCheck.IsZero() {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// nothing new on the next check
+	up.sync(context.Background(), up.tracks[1])
+	if images, _ := db.ListImages("imported"); len(images) != 2 {
+		t.Errorf("Expected no further import, got %+v", images)
+	}
+	if len(u.checks) != 3 || u.checks[2].Version != "900.0.0" {
+		t.Errorf("Expected a check from the imported version, got %+v", u.checks)
+	}
+}
+
+func TestUpstreamHashMismatch(t *testing.T) {
+	_, cleanup := newConformanceServer(t)
+	defer cleanup()
+	defer func(old []*upstream) { upstreams = old }(upstreams)
+
+	u := newFakeUpstream("900.0.0", []byte("upstream image of 900.0.0"))
+	defer u.Close()
+	u.sha256, _ = payloadHashes([]byte("something else"))
+
+	err := setUpstreams([]upstreamConfig{{Name: "coreos", URL: u.URL + "/v1/update/", Channels: map[string]string{"stable": "stable"}}})
+	if err != nil {
+		t.Fatalf("setUpstreams: %v", err.Error())
+	}
+
+	up := upstreams[0]
+	up.sync(context.Background(), up.tracks[0])
+
+	if images, _ := db.ListImages("stable"); len(images) != 0 {
+		t.Errorf("Expected nothing to be imported, got %+v", images)
+	}
+	if status := up.tracks[0].currentStatus(); status.LastError == "" || status.LastImported != "" {
+		t.Errorf("Expected the error to be reported, got %+v", status)
+	}
+}
+
+func TestUpstreamOversizedDownload(t *testing.T) {
+	_, cleanup := newConformanceServer(t)
+	defer cleanup()
+	defer func(old []*upstream) { upstreams = old }(upstreams)
+
+	u := newFakeUpstream("900.0.0", []byte("upstream image of 900.0.0"))
+	defer u.Close()
+	u.trailer = []byte("and then some")
+
+	err := setUpstreams([]upstreamConfig{{Name: "coreos", URL: u.URL + "/v1/update/", Channels: map[string]string{"stable": "stable"}}})
+	if err != nil {
+		t.Fatalf("setUpstreams: %v", err.Error())
+	}
+
+	up := upstreams[0]
+	up.sync(context.Background(), up.tracks[0])
+
+	if images, _ := db.ListImages("stable"); len(images) != 0 {
+		t.Errorf("Expected nothing to be imported, got %+v", images)
+	}
+	if status := up.tracks[0].currentStatus(); !strings.Contains(status.LastError, "more than the 25 bytes in the manifest") {
+		t.Errorf("Expected the oversized download to be reported, got %+v", status)
+	}
+}
+
+func TestUpstreamSyncStops(t *testing.T) {
+	_, cleanup := newConformanceServer(t)
+	defer cleanup()
+	defer func(old []*upstream) { upstreams = old }(upstreams)
+
+	u := newFakeUpstream("900.0.0", []byte("upstream image of 900.0.0"))
+	defer u.Close()
+	u.downloading = make(chan struct{})
+
+	err := setUpstreams([]upstreamConfig{{Name: "coreos", URL: u.URL + "/v1/update/", Channels: map[string]string{"stable": "stable"}}})
+	if err != nil {
+		t.Fatalf("setUpstreams: %v", err.Error())
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		runUpstreamSync(time.Hour, stop)
+		close(stopped)
+	}()
+
+	<-u.downloading
+	close(stop)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the running download to be aborted")
+	}
+}
+
+func TestSetUpstreams(t *testing.T) {
+	defer func(old []*upstream) { upstreams = old }(upstreams)
+
+	invalid := [][]upstreamConfig{
+		{{URL: "http://a.example.com/", Channels: map[string]string{"stable": "stable"}}},
+		{{Name: "a", URL: "a.example.com", Channels: map[string]string{"stable": "stable"}}},
+		{{Name: "a", URL: "http://a.example.com/"}},
+		{{Name: "a", URL: "http://a.example.com/", Channels: map[string]string{"stable": "x", "beta": "x"}}},
+		{{Name: "a", URL: "http://a.example.com/", Channels: map[string]string{"stable": "a"}}, {Name: "a", URL: "http://b.example.com/", Channels: map[string]string{"stable": "b"}}},
+	}
+	for _, configured := range invalid {
+		if err := setUpstreams(configured); err == nil {
+			t.Errorf("Expected an error for %+v", configured)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// kinds of webhook messages
+const (
+	webhookPayloadAdded    = "payload_added"
+	webhookPayloadDeleted  = "payload_deleted"
+	webhookPayloadAttached = "payload_attached"
+	webhookPayloadYanked   = "payload_yanked"
+	webhookPayloadUnyanked = "payload_unyanked"
+	webhookForceDowngrade  = "channel_force_downgrade"
+	webhookMachineError    = "machine_error"
+)
+
+const (
+	webhookQueueSize       = 1000
+	webhookDeliveryTimeout = 10 * time.Second
+)
+
+// body of a webhook request
+type webhookMessage struct {
+	Kind      string      `json:"kind"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Delivers webhook messages in the background, retrying failed requests with
+// exponential backoff. Messages which could not be delivered are recorded as
+// dead letters in the database.
+type webhookNotifier struct {
+	retries   int
+	retryBase time.Duration
+	client    *http.Client
+	targets   []*webhookTarget
+
+	// guards against queueing after Close
+	mutex  sync.RWMutex
+	closed bool
+	// closed by Close, ending the wait for retries
+	closing chan struct{}
+}
+
+// A webhook URL with its own queue and worker, so that an endpoint which is
+// down only delays the messages meant for it.
+type webhookTarget struct {
+	url      string
+	notifier *webhookNotifier
+	queue    chan []byte
+	done     chan struct{}
+}
+
+// a message waiting for its next delivery attempt
+type webhookDelivery struct {
+	body    []byte
+	attempt int
+	next    time.Time
+	err     error
+}
+
+var notifier *webhookNotifier
+
+func newWebhookNotifier(urls []string, retries int, retryBase time.Duration) *webhookNotifier {
+	n := &webhookNotifier{
+		retries:   retries,
+		retryBase: retryBase,
+		client:    &http.Client{Timeout: webhookDeliveryTimeout},
+		closing:   make(chan struct{}),
+	}
+
+	for _, url := range urls {
+		t := &webhookTarget{
+			url:      url,
+			notifier: n,
+			queue:    make(chan []byte, webhookQueueSize),
+			done:     make(chan struct{}),
+		}
+		n.targets = append(n.targets, t)
+
+		go t.run()
+	}
+
+	return n
+}
+
+// queue a message for delivery to all webhooks and live stream clients; never blocks
+func notify(kind string, data interface{}) {
+	broadcast(kind, data)
+
+	if notifier == nil || len(notifier.targets) == 0 {
+		return
+	}
+
+	msg := webhookMessage{Kind: kind, Timestamp: time.Now().UTC(), Data: data}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("Webhook: encoding '%v' message: %v", kind, err.Error())
+		return
+	}
+
+	notifier.mutex.RLock()
+	defer notifier.mutex.RUnlock()
+
+	for _, t := range notifier.targets {
+		if notifier.closed {
+			// a request still running after the shutdown timeout
+			recordDeadLetter(t.url, body, "shutting down")
+			continue
+		}
+
+		select {
+		case t.queue <- body:
+		default:
+			log.Errorf("Webhook queue for '%v' full, dropping '%v' message", t.url, kind)
+			recordDeadLetter(t.url, body, "queue full")
+		}
+	}
+}
+
+// Stop accepting messages and wait until the queued ones are handled. Each
+// gets a single attempt, and messages waiting for a retry are recorded as
+// dead letters right away, so that shutting down does not wait out the
+// backoff.
+func (n *webhookNotifier) Close() {
+	n.mutex.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.closing)
+		for _, t := range n.targets {
+			close(t.queue)
+		}
+	}
+	n.mutex.Unlock()
+
+	for _, t := range n.targets {
+		<-t.done
+	}
+}
+
+// Deliver the queued messages and retry the failed ones when they are due,
+// until the notifier is closed. Messages waiting for a retry count against
+// the queue size.
+func (t *webhookTarget) run() {
+	defer close(t.done)
+
+	var pending []*webhookDelivery
+
+	for {
+		in := t.queue
+		if len(pending) >= webhookQueueSize {
+			in = nil
+		}
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if len(pending) > 0 {
+			next := pending[0].next
+			for _, d := range pending[1:] {
+				if d.next.Before(next) {
+					next = d.next
+				}
+			}
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+
+		closing := false
+		select {
+		case <-t.notifier.closing:
+			closing = true
+		case body, ok := <-in:
+			if !ok {
+				closing = true
+				break
+			}
+			if d := t.deliver(&webhookDelivery{body: body}); d != nil {
+				pending = append(pending, d)
+			}
+		case now := <-due:
+			var waiting []*webhookDelivery
+			for _, d := range pending {
+				if d.next.After(now) {
+					waiting = append(waiting, d)
+				} else if d = t.deliver(d); d != nil {
+					waiting = append(waiting, d)
+				}
+			}
+			pending = waiting
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if closing {
+			t.drain(pending)
+			return
+		}
+	}
+}
+
+// on Close, record the messages waiting for a retry as dead letters and make
+// one attempt for each queued message; once one fails, the endpoint is taken
+// to be down and the rest are not attempted
+func (t *webhookTarget) drain(pending []*webhookDelivery) {
+	for _, d := range pending {
+		recordDeadLetter(t.url, d.body, "shutting down: "+d.err.Error())
+	}
+
+	var failed error
+	for body := range t.queue {
+		if failed == nil {
+			failed = t.notifier.post(t.url, body)
+			if failed == nil {
+				continue
+			}
+			log.Warnf("Webhook: delivery to '%v' failed while shutting down: %v", t.url, failed.Error())
+		}
+		recordDeadLetter(t.url, body, "shutting down: "+failed.Error())
+	}
+}
+
+// Make an attempt to deliver the message. Returns it with the time of its
+// next attempt if it failed and may be retried.
+func (t *webhookTarget) deliver(d *webhookDelivery) *webhookDelivery {
+	n := t.notifier
+
+	d.err = n.post(t.url, d.body)
+	if d.err == nil {
+		return nil
+	}
+	log.Warnf("Webhook: delivery to '%v' failed (attempt %v): %v", t.url, d.attempt+1, d.err.Error())
+
+	if d.attempt >= n.retries {
+		recordDeadLetter(t.url, d.body, d.err.Error())
+		return nil
+	}
+
+	d.next = time.Now().Add(n.retryBase << uint(d.attempt))
+	d.attempt++
+	return d
+}
+
+func (n *webhookNotifier) post(url string, body []byte) error {
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status '%v'", resp.Status)
+	}
+
+	return nil
+}
+
+func recordDeadLetter(url string, body []byte, reason string) {
+	err := db.AddWebhookDeadLetter(url, string(body), reason)
+	if err != nil {
+		log.Errorf("Webhook: recording undelivered message for '%v': %v", url, err.Error())
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	defer func(old userDB) { db = old }(db)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+
+	var mutex sync.Mutex
+	received := []webhookMessage{}
+	failures := 0
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// the first attempt fails, the retry succeeds
+		if failures == 0 {
+			failures++
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+
+		var msg webhookMessage
+		err := json.Unmarshal(body, &msg)
+		if err != nil {
+			t.Errorf("Unmarshal: %v", err.Error())
+		}
+		received = append(received, msg)
+	}))
+	defer good.Close()
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	notifier = newWebhookNotifier([]string{good.URL, bad.URL}, 2, time.Millisecond)
+	notify(webhookPayloadAdded, map[string]interface{}{"id": "foo", "channel": "stable"})
+
+	// Close gives up on retries, so wait for the one to the good endpoint
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mutex.Lock()
+		n := len(received)
+		mutex.Unlock()
+		if n > 0 {
+			break
+		}
+	}
+	notifier.Close()
+	notifier = nil
+
+	if n := len(received); n != 1 {
+		t.Fatalf("Expected 1 delivered message, got %v", n)
+	}
+	if received[0].Kind != webhookPayloadAdded {
+		t.Errorf("Expected message of kind '%v', got '%v'", webhookPayloadAdded, received[0].Kind)
+	}
+	if data, ok := received[0].Data.(map[string]interface{}); !ok || data["id"] != "foo" {
+		t.Errorf("Unexpected message data %+v", received[0].Data)
+	}
+
+	letters, err := db.GetWebhookDeadLetters()
+	if err != nil {
+		t.Errorf("GetWebhookDeadLetters: %v", err.Error())
+	}
+	if len(letters) != 1 || letters[0].URL != bad.URL {
+		t.Errorf("Expected a dead letter for '%v', got %+v", bad.URL, letters)
+	}
+}
+
+func TestWebhookSlowEndpoint(t *testing.T) {
+	defer func(old userDB) { db = old }(db)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+
+	received := make(chan struct{}, 10)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer fast.Close()
+
+	notifier = newWebhookNotifier([]string{slow.URL, fast.URL}, 5, time.Hour)
+	notify(webhookPayloadAdded, map[string]interface{}{"id": "foo", "channel": "stable"})
+	notify(webhookPayloadAttached, map[string]interface{}{"id": "foo", "channel": "beta"})
+
+	// the endpoint which hangs does not hold up the other one
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 deliveries to the responsive endpoint, got %v", i)
+		}
+	}
+
+	close(release)
+	notifier.Close()
+	notifier = nil
+}
+
+func TestWebhookCloseSkipsRetries(t *testing.T) {
+	defer func(old userDB) { db = old }(db)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+
+	attempts := make(chan struct{}, 10)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- struct{}{}
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	notifier = newWebhookNotifier([]string{down.URL}, 5, time.Hour)
+	notify(webhookPayloadAdded, map[string]interface{}{"id": "foo", "channel": "stable"})
+	<-attempts
+
+	// the first retry would only be due in an hour
+	closed := make(chan struct{})
+	go func() {
+		notifier.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Close not to wait for the retries")
+	}
+	notifier = nil
+
+	letters, err := db.GetWebhookDeadLetters()
+	if err != nil {
+		t.Errorf("GetWebhookDeadLetters: %v", err.Error())
+	}
+	if len(letters) != 1 || letters[0].URL != down.URL || !strings.HasPrefix(letters[0].Reason, "shutting down: ") {
+		t.Errorf("Expected a dead letter for the pending retry, got %+v", letters)
+	}
+}
+
+func TestWebhookNotifyAfterClose(t *testing.T) {
+	defer func(old userDB) { db = old }(db)
+
+	var err error
+	db, err = newSqliteDB(":memory:")
+	if err != nil {
+		t.Fatalf("newSqliteDB: %v", err.Error())
+	}
+	defer db.Close()
+
+	notifier = newWebhookNotifier([]string{"http://192.0.2.1/hook"}, 0, time.Millisecond)
+	notifier.Close()
+
+	// e.g. from a request still running after the shutdown timed out
+	notify(webhookPayloadYanked, map[string]interface{}{"id": "foo", "channel": "stable"})
+	notifier.Close()
+	notifier = nil
+
+	letters, err := db.GetWebhookDeadLetters()
+	if err != nil {
+		t.Errorf("GetWebhookDeadLetters: %v", err.Error())
+	}
+	if len(letters) != 1 || letters[0].Reason != "shutting down" {
+		t.Errorf("Expected the message to be recorded as a dead letter, got %+v", letters)
+	}
+}